@@ -0,0 +1,205 @@
+// Package backup archives every record of a store into a gzip compressed file
+// which is optionally encrypted with a key derived from a passphrase.
+package backup
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/db"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// PassphraseEnv is the environment variable consulted before prompting for a backup passphrase.
+const PassphraseEnv = "BERITHUTILS_BACKUP_PASSPHRASE"
+
+const (
+	magic     = "BERITHBK"
+	version   = 1
+	plain     = 0
+	encrypted = 1
+	saltSize  = 32
+)
+
+// ErrBadPassphrase is returned when an encrypted archive cannot be decrypted.
+var ErrBadPassphrase = errors.New("invalid backup passphrase or corrupted archive")
+
+// Entry is a record of a store.
+type Entry struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+}
+
+// Archive is the content of a backup.
+type Archive struct {
+	Created time.Time `json:"created"`
+	Entries []*Entry  `json:"entries"`
+}
+
+// Snapshot reads every record of a store. LevelDB iterators read an implicit snapshot,
+// so records written meanwhile are not mixed in.
+func Snapshot(store db.Store) (*Archive, error) {
+	a := &Archive{Created: time.Now().UTC()}
+	err := store.Iterate(nil, func(key, value []byte) bool {
+		a.Entries = append(a.Entries, &Entry{Key: key, Value: value})
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Write writes the archive to w. It is encrypted if the passphrase is not empty.
+func Write(w io.Writer, a *Archive, passphrase string) error {
+	var compressed bytes.Buffer
+	gz := gzip.NewWriter(&compressed)
+	if err := json.NewEncoder(gz).Encode(a); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+
+	header := []byte{version, plain}
+	body := compressed.Bytes()
+	if passphrase != "" {
+		header[1] = encrypted
+		salt := make([]byte, saltSize)
+		if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+			return err
+		}
+		aead, err := derive(passphrase, salt)
+		if err != nil {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+			return err
+		}
+		sealed := append(salt, nonce...)
+		body = aead.Seal(sealed, nonce, body, []byte(magic))
+	}
+
+	if _, err := w.Write(append([]byte(magic), header...)); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+// Read reads an archive. The passphrase function is called only if the archive is encrypted.
+func Read(r io.Reader, passphrase func() (string, error)) (*Archive, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) < len(magic)+2 || string(b[:len(magic)]) != magic {
+		return nil, errors.New("not a berithutils backup")
+	}
+	if b[len(magic)] != version {
+		return nil, fmt.Errorf("unknown backup version %d", b[len(magic)])
+	}
+	mode, body := b[len(magic)+1], b[len(magic)+2:]
+
+	switch mode {
+	case plain:
+	case encrypted:
+		p, err := passphrase()
+		if err != nil {
+			return nil, err
+		}
+		if len(body) < saltSize {
+			return nil, ErrBadPassphrase
+		}
+		aead, err := derive(p, body[:saltSize])
+		if err != nil {
+			return nil, err
+		}
+		body = body[saltSize:]
+		if len(body) < aead.NonceSize() {
+			return nil, ErrBadPassphrase
+		}
+		body, err = aead.Open(nil, body[:aead.NonceSize()], body[aead.NonceSize():], []byte(magic))
+		if err != nil {
+			return nil, ErrBadPassphrase
+		}
+	default:
+		return nil, fmt.Errorf("unknown backup mode %d", mode)
+	}
+
+	gz, err := gzip.NewReader(bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	defer gz.Close()
+	var a Archive
+	if err := json.NewDecoder(gz).Decode(&a); err != nil {
+		return nil, fmt.Errorf("failed to decode a backup. %v", err)
+	}
+	return &a, nil
+}
+
+// WriteFile writes a snapshot of the store to the path through a temporary file.
+func WriteFile(store db.Store, path, passphrase string) (*Archive, error) {
+	a, err := Snapshot(store)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	if err := Write(f, a, passphrase); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return nil, err
+	}
+	return a, os.Rename(tmp, path)
+}
+
+// Restore replaces every record of the store with the records of the archive at once.
+func Restore(store db.Store, a *Archive) error {
+	batch := new(db.Batch)
+	err := store.Iterate(nil, func(key, value []byte) bool {
+		batch.Delete(key)
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	for _, e := range a.Entries {
+		batch.Put(e.Key, e.Value)
+	}
+	return store.Write(batch)
+}
+
+func derive(passphrase string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
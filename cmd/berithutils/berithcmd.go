@@ -2,30 +2,47 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"fmt"
+	"github.com/mesia777/berith-utils/filesync"
 	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/mesia777/berith-utils/selector"
 	"github.com/mesia777/berith-utils/types"
 	"github.com/mesia777/berith-utils/utils"
 	"github.com/pkg/sftp"
 	"github.com/urfave/cli"
-	"golang.org/x/crypto/ssh"
-	"io/ioutil"
+	"io"
 	"os"
 	"path/filepath"
-	"strconv"
 	"sync"
 )
 
-const (
-	WORKSPACE = "~/berith-test"
-	INIT      = WORKSPACE + "/init.sh"
-	BUILD     = WORKSPACE + "/build.sh"
-	START     = WORKSPACE + "/start.sh"
-	STOP      = WORKSPACE + "/stop.sh"
-)
-
 var (
+	berithFlags = []cli.Flag{
+		utils.SelectorFlag,
+		utils.ParallelFlag,
+		utils.AllowFailuresFlag,
+		utils.OutputFlag,
+		utils.TemplateFlag,
+		utils.HostKeyPolicyFlag,
+		utils.KnownHostsFlag,
+		utils.ConnectTimeoutFlag,
+		utils.TimeoutFlag,
+		utils.RetryAttemptsFlag,
+		utils.RetryBackoffFlag,
+		utils.RetryMaxBackoffFlag,
+		utils.RetryJitterFlag,
+		utils.RetryOnFlag,
+	}
+
+	commandFlags = append([]cli.Flag{
+		utils.StreamFlag,
+		utils.NoColorFlag,
+	}, berithFlags...)
+
 	berithCommand = cli.Command{
 		Action:   ShowSubCommand,
 		Name:     "berith",
@@ -36,43 +53,61 @@ var (
 				Name:      "init",
 				Usage:     "init nodes",
 				Action:    initNodes,
-				ArgsUsage: "[node name or empty if all]",
+				ArgsUsage: "[node names or empty if all]",
+				Flags:     commandFlags,
 			},
 			{
 				Name:      "build",
 				Usage:     "build nodes",
 				Action:    buildNodes,
-				ArgsUsage: "[node name or empty if all]",
+				ArgsUsage: "[node names or empty if all]",
+				Flags:     commandFlags,
 			},
 			{
 				Name:      "start",
 				Usage:     "start nodes",
 				Action:    startNodes,
-				ArgsUsage: "[node name or empty if all]",
+				ArgsUsage: "[node names or empty if all]",
+				Flags:     commandFlags,
 			},
 			{
 				Name:      "stop",
 				Usage:     "stop nodes",
 				Action:    stopNodes,
-				ArgsUsage: "[node name or empty if all]",
+				ArgsUsage: "[node names or empty if all]",
+				Flags:     commandFlags,
 			},
 			{
 				Name:      "upload",
-				Usage:     "upload files in workspace/berith dir to node",
+				Usage:     "sync files in workspace/berith dir to the remote workspace of nodes",
 				Action:    uploadFiles,
-				ArgsUsage: "[node name or empty if all]",
+				ArgsUsage: "[node names or empty if all]",
+				Flags: append([]cli.Flag{
+					utils.PerNodeFilesFlag,
+					utils.DeleteFlag,
+					utils.ForceFlag,
+					utils.DryRunFlag,
+				}, berithFlags...),
 			},
+			fetchCommand,
+			shellCommand,
+			tunnelCommand,
+			statusCommand,
+			consensusCommand,
+			peersCommand,
+			genesisCommand,
 			{
 				Name:      "command",
 				Usage:     "execute a command",
 				Action:    executeCommand,
-				ArgsUsage: "[node name or empty if all]",
+				ArgsUsage: "[node names or empty if all] <command>",
+				Flags:     commandFlags,
 			},
 		},
 	}
 )
 
-type commandGenerator func(n *types.Node) string
+type commandGenerator func(n *types.Node) (string, error)
 
 // initNodes initialize berith node given cli context
 func initNodes(ctx *cli.Context) error {
@@ -85,10 +120,7 @@ func initNodes(ctx *cli.Context) error {
 		return errors.New("empty nodes to init")
 	}
 
-	executesCommand(nodes, func(n *types.Node) string {
-		return INIT + " " + n.Name
-	})
-	return nil
+	return executesPhase(ctx, nodes, types.PhaseInit)
 }
 
 // buildNodes build berith nodes given cli context
@@ -102,10 +134,7 @@ func buildNodes(ctx *cli.Context) error {
 		return errors.New("empty nodes to build")
 	}
 
-	executesCommand(nodes, func(n *types.Node) string {
-		return BUILD + " " + n.Name
-	})
-	return nil
+	return executesPhase(ctx, nodes, types.PhaseBuild)
 }
 
 // startNodes start berith nodes given cli context
@@ -119,10 +148,7 @@ func startNodes(ctx *cli.Context) error {
 		return errors.New("empty nodes to start")
 	}
 
-	executesCommand(nodes, func(n *types.Node) string {
-		return START + " " + n.Name
-	})
-	return nil
+	return executesPhase(ctx, nodes, types.PhaseStart)
 }
 
 // stopNodes stop berith nodes given cli context
@@ -136,13 +162,10 @@ func stopNodes(ctx *cli.Context) error {
 		return errors.New("empty nodes to stop")
 	}
 
-	executesCommand(nodes, func(n *types.Node) string {
-		return STOP + " " + n.Name
-	})
-	return nil
+	return executesPhase(ctx, nodes, types.PhaseStop)
 }
 
-// uploadConfigs upload files from {workspace}/berith to "~/berith-test/"
+// uploadFiles upload files from {workspace}/berith to the remote workspace of each node
 func uploadFiles(ctx *cli.Context) error {
 	nodes, err := extractNodes(ctx)
 	if err != nil {
@@ -153,230 +176,307 @@ func uploadFiles(ctx *cli.Context) error {
 		return errors.New("empty nodes to upload files")
 	}
 
-	var success, fail []string
-	upload := func(n *types.Node) (bool, string) {
-		// setup sftp
+	workspace, err := utils.GetWorkspace()
+	if err != nil {
+		return err
+	}
+	berithDir := filepath.Join(workspace, "berith")
+	if _, err := os.Stat(berithDir); err != nil {
+		return fmt.Errorf("failed to read dir %s. %v", berithDir, err)
+	}
+
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	policy, err := newRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	defaults, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	upload := func(nodeCtx context.Context, n *types.Node) *remote.Result {
+		r := remote.NewResult(n.Name, "")
 		var out bytes.Buffer
 		out.WriteString("------------------------------------------------\n")
 		out.WriteString(fmt.Sprintf("try to upload files. node : %s\n", n.Name))
+		defer func() {
+			if printer.Text() {
+				fmt.Println(out.String())
+			}
+		}()
 
-		c, err := createSSHClient(n)
+		c, err := createSSHClient(nodeCtx, opts, n)
 		if err != nil {
-			out.WriteString(fmt.Sprintf("failed to create a ssh client. node %s", n.Name))
-			return false, out.String()
+			out.WriteString(fmt.Sprintf("failed to create a ssh client. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ClassifyConnectError(err), err)
 		}
 		defer c.Close()
+		stop := watchdog(nodeCtx, 0, func() { _ = c.Close() })
+		defer stop()
 
 		client, err := sftp.NewClient(c)
 		if err != nil {
-			out.WriteString(fmt.Sprintf("failed to create a sftp client. node %s, %v", n.Name, err))
+			out.WriteString(fmt.Sprintf("failed to create a sftp client. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ErrorSession, err)
 		}
 		defer client.Close()
-
-		workspace, err := utils.GetWorkspace()
-		berithDir := filepath.Join(workspace, "berith")
-		dir, err := ioutil.ReadDir(berithDir)
+		remoteDir := node.RemotePath(node.ResolveLifecycle(n, defaults).Workspace)
+		out.WriteString(fmt.Sprintf("Sync files in %s to %s\n", berithDir, remoteDir))
+
+		// sync files
+		var outLock sync.Mutex
+		syncer := &filesync.Syncer{
+			SFTP:      client,
+			Checksums: filesync.CommandChecksums(c),
+			Delete:    ctx.Bool(utils.DeleteFlag.Name),
+			Force:     ctx.Bool(utils.ForceFlag.Name),
+			DryRun:    ctx.Bool(utils.DryRunFlag.Name),
+			Parallel:  ctx.Int(utils.PerNodeFilesFlag.Name),
+			Logf: func(format string, args ...interface{}) {
+				outLock.Lock()
+				defer outLock.Unlock()
+				out.WriteString(fmt.Sprintf(format, args...))
+				out.WriteByte('\n')
+			},
+		}
+		stats, err := syncer.Sync(berithDir, remoteDir)
+		if stats != nil {
+			r.Stdout = stats.String()
+			out.WriteString(r.Stdout + "\n")
+		}
+		if reason := stop(); reason != nil {
+			out.WriteString(fmt.Sprintf("aborted to upload files. node %s, %v\n", n.Name, reason))
+			return r.Fail(remote.ClassifyRunError(reason), reason)
+		}
 		if err != nil {
-			out.WriteString(fmt.Sprintf("failed to read dir. node %s, %v", n.Name, err))
+			return r.Fail(remote.ErrorTransfer, err)
 		}
-		out.WriteString(fmt.Sprintf("Upload files(#%d) in %s\n", len(dir), berithDir))
-
-		var uploadWait sync.WaitGroup
-		uploadWait.Add(len(dir))
-
-		// upload files
-		for _, info := range dir {
-			file, err := os.Open(filepath.Join(berithDir, info.Name()))
-			if err != nil {
-				out.WriteString(fmt.Sprintf("failed to open a file: %s", file.Name()))
-				uploadWait.Done()
-				continue
-			}
+		return r.Done()
+	}
 
-			go func(file *os.File, info os.FileInfo) {
-				defer uploadWait.Done()
-				f, err := client.Create("berith-test/" + info.Name())
-				if err != nil {
-					fmt.Println("Failed to create a file:", info.Name())
-					out.WriteString(fmt.Sprintf("failed to upload a file: %s,%v", file.Name(), err))
-					return
-				}
-				defer f.Close()
-				read, err := ioutil.ReadAll(file)
-				if err != nil {
-					fmt.Println("Failed to create a file:", info.Name())
-					out.WriteString(fmt.Sprintf("failed to read a file: %s after create,%v", file.Name(), err))
-					return
-				}
-
-				if _, err := f.Write(read); err != nil {
-					fmt.Println("Failed to create a file:", info.Name())
-					out.WriteString(fmt.Sprintf("failed to write content a file: %s,%v", file.Name(), err))
-					return
-				}
-				err = client.Chmod(f.Name(), info.Mode())
-				if err != nil {
-					out.WriteString(fmt.Sprintf("failed to change permission%v", err))
-				}
-			}(file, info)
-		}
-		uploadWait.Wait()
-		return true, out.String()
-	}
-
-	var waitGroup sync.WaitGroup
-	waitGroup.Add(len(nodes))
-	for _, n := range nodes {
-		go func(n *types.Node) {
-			defer waitGroup.Done()
-			result, out := upload(n)
-			if result {
-				success = append(success, n.Name)
-			} else {
-				fail = append(fail, n.Name)
-			}
-			fmt.Println(out)
-		}(n)
+	results := new(remote.Collector)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+		results.Add(policy.Do(nodeCtx, func(attempt int) *remote.Result {
+			return upload(nodeCtx, nodes[i])
+		}))
+	})
+	if printer.Text() {
+		success, fail := results.Summary()
+		fmt.Printf("## Complete to upload. success nodes : %v / failures : %v\n", success, fail)
+		printCancelled(results)
+	} else if err := printer.Print(resultTable(results.Results())); err != nil {
+		return err
 	}
-	waitGroup.Wait()
-	fmt.Printf("## Complete to upload. success nodes : %v / failures : %v\n", success, fail)
-	return nil
+	return checkResults(ctx, results)
 }
 
 func executeCommand(ctx *cli.Context) error {
-	var nodeName, command string
-	switch ctx.NArg() {
-	case 1:
-		command = ctx.Args()[0]
-	case 2:
-		nodeName = ctx.Args()[0]
-		command = ctx.Args()[1]
-	default:
+	if ctx.NArg() < 1 {
 		return errors.New("invalid args")
 	}
+	args := ctx.Args()
+	command := args[len(args)-1]
 
-	var nodes []*types.Node
-	var err error
-
-	if nodeName == "" {
-		nodes, err = node.GetNodes(app.db)
-		if err != nil {
-			return err
-		}
-	} else {
-		n, err := node.GetNode(app.db, ctx.Args()[0])
-		if err != nil {
-			return err
-		}
-		nodes = append(nodes, n)
+	nodes, err := selectNodes(ctx, args[:len(args)-1])
+	if err != nil {
+		return err
 	}
 	if len(nodes) == 0 {
 		return errors.New("empty nodes to execute command")
 	}
 
-	executesCommand(nodes, func(n *types.Node) string {
-		return command
+	return executesCommand(ctx, nodes, func(n *types.Node) (string, error) {
+		return command, nil
 	})
-	return nil
 }
 
-func executesCommand(nodes []*types.Node, cmdGen commandGenerator) {
-	var waitGroup sync.WaitGroup
-	waitGroup.Add(len(nodes))
-
-	var success []string
-	var fail []string
-
-	for _, n := range nodes {
-		go func(n *types.Node) {
-			defer waitGroup.Done()
-			var b bytes.Buffer
-			defer func() {
-				fmt.Println(b.String())
-			}()
-			cmd := cmdGen(n)
-			b.WriteString("------------------------------------------------\n")
-			b.WriteString(fmt.Sprintf("try to execute a command. node : %s, command : %s\n", n.Name, cmd))
-
-			conn, err := createSSHClient(n)
-			if err != nil {
-				b.WriteString("failed to execute. reason : cannot create a ssh client\n")
-				fail = append(fail, n.Name)
-				return
-			}
-			defer conn.Close()
+// executesPhase executes the lifecycle script of a phase on nodes
+func executesPhase(ctx *cli.Context, nodes []*types.Node, phase string) error {
+	defaults, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+	return executesCommand(ctx, nodes, func(n *types.Node) (string, error) {
+		return node.RenderScript(n, node.ResolveLifecycle(n, defaults), phase)
+	})
+}
 
-			session, err := conn.NewSession()
-			if err != nil {
-				b.WriteString("failed to execute. reason : cannot create a session\n")
-				fail = append(fail, n.Name)
-				return
-			}
-			defer session.Close()
-
-			var stdOut bytes.Buffer
-			var stdErr bytes.Buffer
-			session.Stdout = &stdOut
-			session.Stderr = &stdErr
-			err = session.Run(cmd)
-			if err != nil {
-				b.WriteString(fmt.Sprintf("failed to execute a node %s. reason: %v\n", n.Name, err))
-				b.Write(stdErr.Bytes())
-				fail = append(fail, n.Name)
-				return
-			}
-			b.WriteString("success to execute. node: " + n.Name + "\n")
-			b.Write(stdOut.Bytes())
-			b.WriteByte('\n')
-			success = append(success, n.Name)
-		}(n)
-	}
-	waitGroup.Wait()
-	fmt.Printf("## Complete to execute nodes. success %v, fail : %v\n", success, fail)
+// executesCommand executes generated commands on nodes with at most parallel nodes at the same time
+func executesCommand(ctx *cli.Context, nodes []*types.Node, cmdGen commandGenerator) error {
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	policy, err := newRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	stream := newStreamer(ctx, printer.Text(), nodes)
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	results := new(remote.Collector)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+
+		var r *remote.Result
+		if cmd, err := cmdGen(nodes[i]); err != nil {
+			r = remote.NewResult(nodes[i].Name, "").Fail(remote.ErrorConfig, err)
+		} else {
+			r = policy.Do(nodeCtx, func(attempt int) *remote.Result {
+				return executeNodeCommand(nodeCtx, opts, nodes[i], cmd, stream)
+			})
+		}
+		if printer.Text() {
+			printResult(r, stream != nil)
+		}
+		results.Add(r)
+	})
+	if printer.Text() {
+		success, fail := results.Summary()
+		fmt.Printf("## Complete to execute nodes. success %v, fail : %v\n", success, fail)
+		printCancelled(results)
+	} else if err := printer.Print(resultTable(results.Results())); err != nil {
+		return err
+	}
+	return checkResults(ctx, results)
 }
 
-// extractNodes extract nodes given cli context
-func extractNodes(ctx *cli.Context) ([]*types.Node, error) {
-	if ctx.NArg() < 1 {
-		return node.GetNodes(app.db)
+// newStreamer returns a streamer if streaming is enabled. Lines go to stderr unless the output is text
+func newStreamer(ctx *cli.Context, text bool, nodes []*types.Node) *remote.Streamer {
+	if !ctx.Bool(utils.StreamFlag.Name) {
+		return nil
+	}
+	out := os.Stdout
+	if !text {
+		out = os.Stderr
+	}
+	names := make([]string, len(nodes))
+	for i, n := range nodes {
+		names[i] = n.Name
+	}
+	return remote.NewStreamer(out, !ctx.Bool(utils.NoColorFlag.Name) && utils.IsTerminal(out), names)
+}
+
+// executeNodeCommand runs a command on a node and returns its result.
+// Output is also streamed line by line if a streamer is given.
+// The remote process is interrupted when the context is done.
+func executeNodeCommand(ctx context.Context, opts *sshOptions, n *types.Node, cmd string, stream *remote.Streamer) *remote.Result {
+	r := remote.NewResult(n.Name, cmd)
+
+	conn, err := createSSHClient(ctx, opts, n)
+	if err != nil {
+		return r.Fail(remote.ClassifyConnectError(err), err)
 	}
+	defer conn.Close()
 
-	var nodes []*types.Node
-	n, err := node.GetNode(app.db, ctx.Args()[0])
+	session, err := conn.NewSession()
 	if err != nil {
-		return nil, err
+		return r.Fail(remote.ErrorSession, err)
 	}
-	nodes = append(nodes, n)
-	return nodes, nil
+	defer session.Close()
+
+	var stdOut syncBuffer
+	var stdErr syncBuffer
+	session.Stdout = &stdOut
+	session.Stderr = &stdErr
+	if stream != nil {
+		outWriter, errWriter := stream.Writer(n.Name, false), stream.Writer(n.Name, true)
+		defer outWriter.Close()
+		defer errWriter.Close()
+		session.Stdout = io.MultiWriter(&stdOut, outWriter)
+		session.Stderr = io.MultiWriter(&stdErr, errWriter)
+	}
+	if err := session.Start(cmd); err != nil {
+		return r.Fail(remote.ErrorSession, err)
+	}
+	err = waitSession(ctx, session)
+	r.Stdout = stdOut.String()
+	r.Stderr = stdErr.String()
+	if err != nil {
+		return r.Fail(remote.ClassifyRunError(err), err)
+	}
+	return r.Done()
 }
 
-// createSSHClient create a ssh client given node
-func createSSHClient(n *types.Node) (*ssh.Client, error) {
-	h := n.Host
-	if h == nil {
-		return nil, errors.New("cannot create a ssh client. host is nil")
+// printResult display a result of a command to console. Output is omitted if it was streamed
+func printResult(r *remote.Result, streamed bool) {
+	if streamed {
+		if r.Failed() {
+			fmt.Printf("## failed to execute a node %s%s. reason(%s): %s\n", r.Node, attempts(r), r.ErrorClass, r.Error)
+		} else {
+			fmt.Printf("## success to execute. node: %s%s (%v)\n", r.Node, attempts(r), r.Duration)
+		}
+		return
 	}
 
-	var auth ssh.AuthMethod
-	if h.Password != "" {
-		auth = ssh.Password(h.Password)
+	var b bytes.Buffer
+	b.WriteString("------------------------------------------------\n")
+	b.WriteString(fmt.Sprintf("try to execute a command. node : %s, command : %s\n", r.Node, r.Command))
+	if r.Failed() {
+		b.WriteString(fmt.Sprintf("failed to execute a node %s%s. reason(%s): %s\n", r.Node, attempts(r), r.ErrorClass, r.Error))
+		b.WriteString(r.Stderr)
 	} else {
-		pemBytes, err := ioutil.ReadFile(h.KeyPath)
-		if err != nil {
-			return nil, err
-		}
-		key, err := ssh.ParsePrivateKey(pemBytes)
-		auth = ssh.PublicKeys(key)
+		b.WriteString(fmt.Sprintf("success to execute. node: %s%s (%v)\n", r.Node, attempts(r), r.Duration))
+		b.WriteString(r.Stdout)
 	}
+	fmt.Println(b.String())
+}
 
-	config := &ssh.ClientConfig{
-		User: h.User,
-		Auth: []ssh.AuthMethod{
-			auth,
-		},
-		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+// attempts returns the attempt count of a result to display if it was retried
+func attempts(r *remote.Result) string {
+	if r.Attempts > 1 {
+		return fmt.Sprintf(" after %d attempts", r.Attempts)
 	}
+	return ""
+}
+
+// printCancelled display nodes which were cancelled or timed out if any
+func printCancelled(results *remote.Collector) {
+	if cancelled := results.Cancelled(); len(cancelled) > 0 {
+		fmt.Printf("## Cancelled nodes(#%d) : %v\n", len(cancelled), cancelled)
+	}
+}
+
+// checkResults returns an error if any node failed unless failures are allowed
+func checkResults(ctx *cli.Context, results *remote.Collector) error {
+	if ctx.Bool(utils.AllowFailuresFlag.Name) {
+		return nil
+	}
+	return results.Err()
+}
 
-	addr := h.Address + ":" + strconv.Itoa(h.Port)
-	return ssh.Dial("tcp", addr, config)
+// extractNodes extract nodes given node names in args and selector flag
+func extractNodes(ctx *cli.Context) ([]*types.Node, error) {
+	return selectNodes(ctx, ctx.Args())
+}
+
+// selectNodes returns nodes given names, or all nodes if empty, which match the selector flag
+func selectNodes(ctx *cli.Context, names []string) ([]*types.Node, error) {
+	sel, err := selector.Parse(ctx.String(utils.SelectorFlag.Name))
+	if err != nil {
+		return nil, err
+	}
+	return node.SelectNodes(app.db, names, sel)
 }
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"context"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// signalContext returns a context which is cancelled on the first SIGINT or SIGTERM.
+// A second signal terminates the process as usual.
+func signalContext() (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(context.Background())
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-signals:
+			log.Printf("received %v. cancelling remote operations. send it again to exit immediately\n", sig)
+			cancel()
+		case <-ctx.Done():
+		}
+		signal.Stop(signals)
+	}()
+	return ctx, cancel
+}
+
+// nodeContext returns a context of the operation on a single node limited by the timeout flag
+func nodeContext(parent context.Context, ctx *cli.Context) (context.Context, context.CancelFunc) {
+	if timeout := ctx.Duration(utils.TimeoutFlag.Name); timeout > 0 {
+		return context.WithTimeout(parent, timeout)
+	}
+	return context.WithCancel(parent)
+}
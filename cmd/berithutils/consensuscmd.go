@@ -0,0 +1,149 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/consensus"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/output"
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"os"
+	"sync"
+)
+
+var (
+	consensusCommand = cli.Command{
+		Name:      "consensus-check",
+		Usage:     "compare block hashes of nodes over json-rpc to find forks and the highest common block",
+		Action:    checkConsensus,
+		ArgsUsage: "[node names or empty if all]",
+		Flags:     append([]cli.Flag{utils.RPCFlag, utils.RPCDirectFlag}, berithFlags...),
+	}
+)
+
+// checkConsensus query heads of nodes and report which nodes are on which fork
+func checkConsensus(ctx *cli.Context) error {
+	nodes, err := extractNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("empty nodes to check consensus")
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := newRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	defaults, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+	direct := ctx.Bool(utils.RPCDirectFlag.Name)
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	// connections are kept open to sample blocks after every head is known
+	var lock sync.Mutex
+	chains := make(map[string]consensus.Chain, len(nodes))
+	heads := make(map[string]uint64, len(nodes))
+	var sshClients []*ssh.Client
+	defer func() {
+		for _, c := range sshClients {
+			_ = c.Close()
+		}
+	}()
+
+	queryHead := func(nodeCtx context.Context, n *types.Node) *remote.Result {
+		endpoint, err := node.Render(n, node.ResolveLifecycle(n, defaults), ctx.String(utils.RPCFlag.Name))
+		r := remote.NewResult(n.Name, endpoint)
+		if err != nil {
+			return r.Fail(remote.ErrorConfig, err)
+		}
+		client, c, err := newRPCClient(nodeCtx, opts, n, endpoint, direct)
+		if err != nil {
+			return r.Fail(remote.ClassifyConnectError(err), fmt.Errorf("failed to create a ssh client. %v", err))
+		}
+
+		head, err := client.BlockNumber(nodeCtx)
+		if reason := remote.ContextError(nodeCtx); reason != nil {
+			err = reason
+		}
+		if err != nil {
+			closeClient(c)
+			return r.Fail(remote.ErrorRPC, err)
+		}
+		lock.Lock()
+		defer lock.Unlock()
+		chains[n.Name] = client
+		heads[n.Name] = head
+		if c != nil {
+			sshClients = append(sshClients, c)
+		}
+		return r.Done()
+	}
+
+	results := new(remote.Collector)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+		results.Add(policy.Do(nodeCtx, func(attempt int) *remote.Result {
+			return queryHead(nodeCtx, nodes[i])
+		}))
+	})
+	if len(heads) == 0 {
+		if printer.Text() {
+			printFailures(results)
+		}
+		return results.Err()
+	}
+
+	report, err := consensus.Check(runCtx, chains, heads)
+	if err != nil {
+		return err
+	}
+
+	if !printer.Text() {
+		if err := printer.Print(report); err != nil {
+			return err
+		}
+		return checkResults(ctx, results)
+	}
+	tablePrinter, _ := output.NewPrinter(output.FormatTable, "", os.Stdout)
+	if err := tablePrinter.Print(forkTable(report.Nodes)); err != nil {
+		return err
+	}
+	fmt.Printf("## Common ancestor : #%d %s\n", report.Ancestor, report.AncestorHash)
+	for _, f := range report.Forks {
+		if f.ID == 0 {
+			fmt.Printf("## Fork %d (main) : tip #%d %s, nodes(#%d) : %v\n", f.ID, f.Tip, f.TipHash, len(f.Nodes), f.Nodes)
+			continue
+		}
+		fmt.Printf("## Fork %d : tip #%d %s, diverged after #%d, nodes(#%d) : %v\n", f.ID, f.Tip, f.TipHash, f.Common, len(f.Nodes), f.Nodes)
+	}
+	printFailures(results)
+	return checkResults(ctx, results)
+}
+
+// printFailures display nodes which could not be queried with the reasons
+func printFailures(results *remote.Collector) {
+	for _, r := range results.Results() {
+		if r.Failed() {
+			fmt.Printf("## failed to query a node %s%s. reason(%s): %s\n", r.Node, attempts(r), r.ErrorClass, r.Error)
+		}
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/backup"
+	"github.com/mesia777/berith-utils/db"
+	"github.com/mesia777/berith-utils/migration"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	autoBackupPrefix = "auto-"
+	backupExt        = ".bak"
+)
+
+var (
+	dbCommand = cli.Command{
+		Action:   ShowSubCommand,
+		Name:     "db",
+		Usage:    "manage the data store",
+		Category: "NODE COMMANDS",
+		Subcommands: []cli.Command{
+			{
+				Name:   "migrate",
+				Usage:  "upgrade records to the current schema version after taking a backup",
+				Action: migrateDatabase,
+				Flags:  append([]cli.Flag{utils.DryRunFlag}, outputFlags...),
+			},
+			{
+				Name:      "backup",
+				Usage:     "write a consistent snapshot of the store to a compressed archive",
+				ArgsUsage: "<file>",
+				Action:    backupDatabase,
+				Flags:     []cli.Flag{utils.EncryptFlag},
+			},
+			{
+				Name:      "restore",
+				Usage:     "replace every record of the store with an archive after taking an automatic backup",
+				ArgsUsage: "<file>",
+				Action:    restoreDatabase,
+			},
+			{
+				Name:   "verify",
+				Usage:  "check the integrity of the store and report what recovery would lose",
+				Action: verifyDatabase,
+				Flags:  []cli.Flag{utils.RecoverFlag},
+			},
+		},
+	}
+)
+
+// migrateDatabase display pending migrations and apply them unless dry run
+func migrateDatabase(ctx *cli.Context) error {
+	plan, err := migration.NewPlan(app.db)
+	if err != nil {
+		return err
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	if !printer.Text() {
+		if err := printer.Print(plan); err != nil {
+			return err
+		}
+	} else {
+		fmt.Printf("## Schema version : %d -> %d, changed records : %d, invalid records : %d\n", plan.From, plan.To, len(plan.Changes), len(plan.Invalid))
+		for _, c := range plan.Changes {
+			fmt.Printf("[v%d] %s : %s\n  - %s\n  + %s\n", c.Version, c.Key, c.Description, c.Old, c.New)
+		}
+		for _, i := range plan.Invalid {
+			fmt.Printf("[v%d] %s : invalid record is skipped. %s\n", i.Version, i.Key, i.Error)
+		}
+	}
+	if !ctx.Bool(utils.DryRunFlag.Name) && plan.Pending() {
+		if err := applyMigration(app.db, plan); err != nil {
+			return err
+		}
+	}
+	if len(plan.Invalid) > 0 {
+		return fmt.Errorf("%d invalid records cannot be migrated. fix them or remove them with `node delete`", len(plan.Invalid))
+	}
+	return nil
+}
+
+// migrateStore upgrades a store opened by the app if it is behind the current schema version
+func migrateStore(store db.Store) error {
+	plan, err := migration.NewPlan(store)
+	if err != nil {
+		return err
+	}
+	if !plan.Pending() {
+		return nil
+	}
+	return applyMigration(store, plan)
+}
+
+// applyMigration takes a backup of a store which has records to change, then applies the plan
+func applyMigration(store db.Store, plan *migration.Plan) error {
+	if len(plan.Changes) > 0 {
+		if err := autoBackup(store, fmt.Sprintf("migrate-v%d", plan.From)); err != nil {
+			return err
+		}
+	}
+	if err := plan.Apply(store); err != nil {
+		return fmt.Errorf("failed to migrate the store. %v", err)
+	}
+	if len(plan.Invalid) > 0 {
+		for _, i := range plan.Invalid {
+			log.Printf("WARN: skipped invalid record %s. %s\n", i.Key, i.Error)
+		}
+		log.Printf("WARN: the store stays at schema version %d until invalid records are fixed or removed with `node delete`\n", plan.From)
+		return nil
+	}
+	if len(plan.Changes) > 0 {
+		log.Printf("migrated the store from schema version %d to %d. changed records : %d\n", plan.From, plan.To, len(plan.Changes))
+	}
+	return nil
+}
+
+// backupDatabase writes a snapshot of the store to the given file
+func backupDatabase(ctx *cli.Context) error {
+	path := ctx.Args().First()
+	if path == "" {
+		return errors.New("backup file is required")
+	}
+	var passphrase string
+	if ctx.Bool(utils.EncryptFlag.Name) {
+		p, err := readNewPassphrase(backup.PassphraseEnv, "backup")
+		if err != nil {
+			return err
+		}
+		if p == "" {
+			return errors.New("empty backup passphrase")
+		}
+		passphrase = p
+	}
+	a, err := backup.WriteFile(app.db, path, passphrase)
+	if err != nil {
+		return fmt.Errorf("failed to back up the store. %v", err)
+	}
+	fmt.Printf("## Backed up %d records to %s\n", len(a.Entries), path)
+	return nil
+}
+
+// restoreDatabase replaces the store with the given archive and upgrades it to the current schema
+func restoreDatabase(ctx *cli.Context) error {
+	path := ctx.Args().First()
+	if path == "" {
+		return errors.New("backup file is required")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	a, err := backup.Read(f, readBackupPassphrase)
+	_ = f.Close()
+	if err != nil {
+		return err
+	}
+	if err := autoBackup(app.db, "restore"); err != nil {
+		return err
+	}
+	if err := backup.Restore(app.db, a); err != nil {
+		return fmt.Errorf("failed to restore the store. %v", err)
+	}
+	fmt.Printf("## Restored %d records taken at %s from %s\n", len(a.Entries), a.Created.Local().Format(time.RFC3339), path)
+	return migrateStore(app.db)
+}
+
+// verifyDatabase checks that a leveldb store opens and reads, then checks schema version and node records.
+// A corrupted store is recovered only with the recover flag, after reporting what recovery would lose.
+func verifyDatabase(ctx *cli.Context) error {
+	if kind := app.storeKind; kind == "" || kind == "leveldb" {
+		path, err := utils.GetDatabasePath()
+		if err != nil {
+			return err
+		}
+		check, err := db.VerifyDatabase(path)
+		if err != nil {
+			return err
+		}
+		if !check.Healthy() {
+			reportCorruption(check)
+			if !ctx.Bool(utils.RecoverFlag.Name) {
+				return errors.New("store is corrupted. run `db verify --recover` to recover it")
+			}
+			copied, err := db.RecoverDatabase(path)
+			if err != nil {
+				return fmt.Errorf("failed to recover the store. %v", err)
+			}
+			fmt.Printf("## Recovered the store. the corrupted one is copied to %s\n", copied)
+		}
+	}
+
+	store, err := createStore(app.storeKind)
+	if err != nil {
+		return err
+	}
+	app.db = store
+	plan, err := migration.NewPlan(store)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("## Schema version : %d, current : %d, pending changes : %d, invalid records : %d\n", plan.From, plan.To, len(plan.Changes), len(plan.Invalid))
+	for _, i := range plan.Invalid {
+		fmt.Printf("  - %s : %s\n", i.Key, i.Error)
+	}
+
+	var count int
+	var broken []string
+	err = store.Iterate([]byte(types.NodePrefix), func(key, value []byte) bool {
+		count++
+		var n *types.Node
+		if err := json.Unmarshal(value, &n); err != nil {
+			broken = append(broken, fmt.Sprintf("%s : %v", key, err))
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("## Node records : %d, undecodable : %d\n", count, len(broken))
+	for _, b := range broken {
+		fmt.Printf("  - %s\n", b)
+	}
+	if len(broken) > 0 {
+		return fmt.Errorf("%d node records cannot be decoded", len(broken))
+	}
+	if len(plan.Invalid) > 0 {
+		return fmt.Errorf("%d records cannot be migrated", len(plan.Invalid))
+	}
+	return nil
+}
+
+// reportCorruption prints records which recovery would drop, compared to what is readable and to the latest automatic backup
+func reportCorruption(check *db.Check) {
+	fmt.Printf("## Store %s is corrupted. %v\n", check.Path, check.Err)
+	fmt.Printf("readable records : %d, records kept by recovery : %d\n", len(check.Readable), len(check.Recovered))
+	for _, key := range check.Lost() {
+		fmt.Printf("  - lost : %s\n", key)
+	}
+
+	dir, err := backupDir()
+	if err != nil {
+		return
+	}
+	backups, err := autoBackups(dir)
+	if err != nil || len(backups) == 0 {
+		fmt.Println("no automatic backup to compare with")
+		return
+	}
+	latest := filepath.Join(dir, backups[len(backups)-1])
+	f, err := os.Open(latest)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	a, err := backup.Read(f, readBackupPassphrase)
+	if err != nil {
+		fmt.Printf("cannot read the latest backup %s. %v\n", latest, err)
+		return
+	}
+	var missing, changed int
+	for _, e := range a.Entries {
+		value, ok := check.Recovered[string(e.Key)]
+		switch {
+		case !ok:
+			missing++
+			fmt.Printf("  - in %s, not recovered : %s\n", filepath.Base(latest), e.Key)
+		case string(value) != string(e.Value):
+			changed++
+		}
+	}
+	fmt.Printf("compared to %s : %d records missing, %d records changed after it\n", latest, missing, changed)
+}
+
+// autoBackup writes a snapshot of a store which has records into the workspace and removes the oldest
+// automatic backups beyond the number to keep
+func autoBackup(store db.Store, reason string) error {
+	if app.backupKeep <= 0 {
+		return nil
+	}
+	empty := true
+	err := store.Iterate(nil, func(key, value []byte) bool {
+		empty = false
+		return false
+	})
+	if err != nil || empty {
+		return err
+	}
+	dir, err := backupDir()
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(dir, fmt.Sprintf("%s%s-%s%s", autoBackupPrefix, time.Now().Format("20060102-150405.000"), reason, backupExt))
+	if _, err := backup.WriteFile(store, path, ""); err != nil {
+		return fmt.Errorf("failed to back up the store. %v", err)
+	}
+	log.Printf("backed up the store before %s : %s\n", reason, path)
+
+	backups, err := autoBackups(dir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > app.backupKeep {
+		if err := os.Remove(filepath.Join(dir, backups[0])); err != nil {
+			return err
+		}
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// autoBackups returns file names of automatic backups from the oldest
+func autoBackups(dir string) ([]string, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, f := range files {
+		if f.Mode().IsRegular() && strings.HasPrefix(f.Name(), autoBackupPrefix) && strings.HasSuffix(f.Name(), backupExt) {
+			names = append(names, f.Name())
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+// backupDir returns the directory of automatic backups in the workspace
+func backupDir() (string, error) {
+	workspace, err := utils.GetWorkspace()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(workspace, "backups"), nil
+}
+
+// readBackupPassphrase reads the passphrase of an encrypted backup from the env or the terminal
+func readBackupPassphrase() (string, error) {
+	if p, ok := os.LookupEnv(backup.PassphraseEnv); ok {
+		return p, nil
+	}
+	return utils.ReadPassphrase("backup passphrase: ")
+}
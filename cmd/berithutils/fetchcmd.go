@@ -0,0 +1,172 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/filesync"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/pkg/sftp"
+	"github.com/urfave/cli"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+var (
+	fetchCommand = cli.Command{
+		Name:      "fetch",
+		Usage:     "fetch remote files of nodes into {workspace}/<local dir>/<node name>",
+		Action:    fetchFiles,
+		ArgsUsage: "<remote glob> <local dir> [node names or empty if all]",
+		Flags:     append([]cli.Flag{utils.BundleFlag}, berithFlags...),
+	}
+)
+
+// fetchFiles download files matching a remote glob from nodes into per node directories
+func fetchFiles(ctx *cli.Context) error {
+	if ctx.NArg() < 2 {
+		return errors.New("remote glob and local dir must be given")
+	}
+	pattern, localDir := ctx.Args()[0], ctx.Args()[1]
+	if !filepath.IsAbs(localDir) {
+		workspace, err := utils.GetWorkspace()
+		if err != nil {
+			return err
+		}
+		localDir = filepath.Join(workspace, localDir)
+	}
+
+	nodes, err := selectNodes(ctx, ctx.Args()[2:])
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("empty nodes to fetch files")
+	}
+	localNames := make(map[string]string, len(nodes))
+	for _, n := range nodes {
+		dir := localName(n.Name)
+		if other, ok := localNames[dir]; ok {
+			return fmt.Errorf("nodes %s and %s are fetched into the same directory %s", other, n.Name, dir)
+		}
+		localNames[dir] = n.Name
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := newRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	defaults, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	fetch := func(nodeCtx context.Context, n *types.Node) *remote.Result {
+		remotePattern := node.ResolveRemotePath(node.ResolveLifecycle(n, defaults).Workspace, pattern)
+		r := remote.NewResult(n.Name, remotePattern)
+		var out bytes.Buffer
+		out.WriteString("------------------------------------------------\n")
+		out.WriteString(fmt.Sprintf("try to fetch files. node : %s, pattern : %s\n", n.Name, remotePattern))
+		defer func() {
+			if printer.Text() {
+				fmt.Println(out.String())
+			}
+		}()
+
+		c, err := createSSHClient(nodeCtx, opts, n)
+		if err != nil {
+			out.WriteString(fmt.Sprintf("failed to create a ssh client. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ClassifyConnectError(err), err)
+		}
+		defer c.Close()
+		stop := watchdog(nodeCtx, 0, func() { _ = c.Close() })
+		defer stop()
+
+		client, err := sftp.NewClient(c)
+		if err != nil {
+			out.WriteString(fmt.Sprintf("failed to create a sftp client. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ErrorSession, err)
+		}
+		defer client.Close()
+
+		var outLock sync.Mutex
+		stats, err := filesync.Fetch(client, remotePattern, filepath.Join(localDir, localName(n.Name)), func(format string, args ...interface{}) {
+			outLock.Lock()
+			defer outLock.Unlock()
+			out.WriteString(fmt.Sprintf(format, args...))
+			out.WriteByte('\n')
+		})
+		if stats != nil {
+			r.Stdout = stats.String()
+			out.WriteString(r.Stdout + "\n")
+		}
+		if reason := stop(); reason != nil {
+			out.WriteString(fmt.Sprintf("aborted to fetch files. node %s, %v\n", n.Name, reason))
+			return r.Fail(remote.ClassifyRunError(reason), reason)
+		}
+		if err != nil {
+			out.WriteString(err.Error() + "\n")
+			return r.Fail(remote.ErrorTransfer, err)
+		}
+		return r.Done()
+	}
+
+	results := new(remote.Collector)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+		results.Add(policy.Do(nodeCtx, func(attempt int) *remote.Result {
+			return fetch(nodeCtx, nodes[i])
+		}))
+	})
+
+	success, fail := results.Summary()
+	if printer.Text() {
+		fmt.Printf("## Complete to fetch. success nodes : %v / failures : %v\n", success, fail)
+		printCancelled(results)
+	} else if err := printer.Print(resultTable(results.Results())); err != nil {
+		return err
+	}
+
+	if ctx.Bool(utils.BundleFlag.Name) && len(success) > 0 {
+		bundle := localDir + ".tar.gz"
+		if err := filesync.Bundle(localDir, bundle); err != nil {
+			return fmt.Errorf("failed to bundle %s. %v", localDir, err)
+		}
+		if printer.Text() {
+			fmt.Printf("## Bundled fetched files into %s\n", bundle)
+		}
+	}
+	return checkResults(ctx, results)
+}
+
+// localName returns a node name usable as a single local directory name
+func localName(name string) string {
+	name = strings.Map(func(r rune) rune {
+		switch r {
+		case '/', '\\', ':', 0:
+			return '_'
+		}
+		return r
+	}, name)
+	if name == "" || name == "." || name == ".." {
+		return "_" + name
+	}
+	return name
+}
@@ -0,0 +1,376 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/genesis"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/rpc"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/pkg/sftp"
+	"github.com/urfave/cli"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+var (
+	genesisCommand = cli.Command{
+		Action: ShowSubCommand,
+		Name:   "genesis",
+		Usage:  "create and distribute the genesis of a private network",
+		Subcommands: []cli.Command{
+			{
+				Name:      "create",
+				Usage:     "render a genesis with accounts of nodes into the workspace",
+				Action:    createGenesis,
+				ArgsUsage: "[node names or empty if all]",
+				Flags: append([]cli.Flag{
+					utils.GenesisFileFlag,
+					utils.GenesisTemplateFlag,
+					utils.ChainIDFlag,
+					utils.BalanceFlag,
+					utils.AccountExecFlag,
+					utils.RPCFlag,
+					utils.RPCDirectFlag,
+				}, berithFlags...),
+			},
+			{
+				Name:      "push",
+				Usage:     "upload the genesis to nodes, and with --init apply it and verify that they have the same genesis hash",
+				Action:    pushGenesis,
+				ArgsUsage: "[node names or empty if all]",
+				Flags: append([]cli.Flag{
+					utils.GenesisFileFlag,
+					utils.GenesisRemoteFlag,
+					utils.InitFlag,
+					utils.RPCFlag,
+					utils.RPCDirectFlag,
+				}, berithFlags...),
+			},
+		},
+	}
+)
+
+// genesisPath returns the local genesis file given cli context
+func genesisPath(ctx *cli.Context) (string, error) {
+	p := ctx.String(utils.GenesisFileFlag.Name)
+	if filepath.IsAbs(p) {
+		return p, nil
+	}
+	workspace, err := utils.GetWorkspace()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(workspace, p), nil
+}
+
+// createGenesis collect accounts of nodes and render a genesis file given cli context
+func createGenesis(ctx *cli.Context) error {
+	nodes, err := extractNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("empty nodes to create a genesis")
+	}
+	tmpl := genesis.DefaultTemplate
+	if p := ctx.String(utils.GenesisTemplateFlag.Name); p != "" {
+		b, err := ioutil.ReadFile(p)
+		if err != nil {
+			return err
+		}
+		tmpl = string(b)
+	}
+	out, err := genesisPath(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := newRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	defaults, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	var accountLock sync.Mutex
+	accounts := make(map[string]string, len(nodes))
+	collect := func(nodeCtx context.Context, n *types.Node) *remote.Result {
+		r := remote.NewResult(n.Name, "")
+		c, err := createSSHClient(nodeCtx, opts, n)
+		if err != nil {
+			return r.Fail(remote.ClassifyConnectError(err), err)
+		}
+		defer c.Close()
+		stop := watchdog(nodeCtx, 0, func() { _ = c.Close() })
+		defer stop()
+
+		source, account, err := queryValue(nodeCtx, ctx, n, node.ResolveLifecycle(n, defaults), c, ctx.String(utils.AccountExecFlag.Name),
+			func(client *rpc.Client) (string, error) {
+				return client.Coinbase(nodeCtx)
+			})
+		r.Command = source
+		if reason := stop(); reason != nil {
+			return r.Fail(remote.ClassifyRunError(reason), reason)
+		}
+		if err == nil && account == "" {
+			err = remote.WithClass(remote.ErrorRPC, errors.New("empty account"))
+		}
+		if err != nil {
+			return r.Fail(remote.ClassifyRunError(err), fmt.Errorf("failed to get an account. %v", err))
+		}
+		r.Stdout = account
+		if err := saveAccount(n, account); err != nil {
+			log.Printf("failed to store an account of node %s. %v\n", n.Name, err)
+		}
+		accountLock.Lock()
+		accounts[n.Name] = account
+		accountLock.Unlock()
+		return r.Done()
+	}
+
+	results := new(remote.Collector)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+		r := policy.Do(nodeCtx, func(attempt int) *remote.Result {
+			return collect(nodeCtx, nodes[i])
+		})
+		if !r.Failed() {
+			return
+		}
+		// fall back to the account stored by a previous collection
+		if nodes[i].Account != "" {
+			log.Printf("failed to get an account of node %s. use the stored one. reason(%s): %s\n", r.Node, r.ErrorClass, r.Error)
+			accountLock.Lock()
+			accounts[nodes[i].Name] = nodes[i].Account
+			accountLock.Unlock()
+			return
+		}
+		log.Printf("failed to get an account of node %s%s. reason(%s): %s\n", r.Node, attempts(r), r.ErrorClass, r.Error)
+		results.Add(r)
+	})
+	if err := checkResults(ctx, results); err != nil {
+		return err
+	}
+
+	data := &genesis.Data{
+		ChainID:   ctx.Int64(utils.ChainIDFlag.Name),
+		Timestamp: fmt.Sprintf("0x%x", time.Now().Unix()),
+		Balance:   ctx.String(utils.BalanceFlag.Name),
+	}
+	seen := make(map[string]bool)
+	for _, n := range nodes {
+		account, ok := accounts[n.Name]
+		if !ok {
+			continue
+		}
+		data.Nodes = append(data.Nodes, &genesis.Node{Name: n.Name, Account: account, Enode: n.Enode, Labels: n.Labels})
+		if !seen[account] {
+			seen[account] = true
+			data.Accounts = append(data.Accounts, account)
+		}
+	}
+	if len(data.Accounts) == 0 {
+		return errors.New("no account to allocate")
+	}
+
+	content, err := genesis.Render(tmpl, data)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(out), 0755); err != nil {
+		return err
+	}
+	if err := ioutil.WriteFile(out, content, 0644); err != nil {
+		return err
+	}
+	log.Printf("success to create a genesis with %d accounts : %s\n", len(data.Accounts), out)
+	return nil
+}
+
+// pushGenesis upload the genesis to nodes and compare their genesis hashes given cli context
+func pushGenesis(ctx *cli.Context) error {
+	nodes, err := extractNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("empty nodes to push a genesis")
+	}
+	local, err := genesisPath(ctx)
+	if err != nil {
+		return err
+	}
+	content, err := ioutil.ReadFile(local)
+	if err != nil {
+		return fmt.Errorf("failed to read a genesis. %v", err)
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := newRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	defaults, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+	runInit := ctx.Bool(utils.InitFlag.Name)
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	var hashLock sync.Mutex
+	hashes := make(map[string]string, len(nodes))
+	push := func(nodeCtx context.Context, n *types.Node) *remote.Result {
+		l := node.ResolveLifecycle(n, defaults)
+		remotePath, err := node.Render(n, l, ctx.String(utils.GenesisRemoteFlag.Name))
+		if err != nil {
+			return remote.NewResult(n.Name, "").Fail(remote.ErrorConfig, err)
+		}
+		remotePath = node.ResolveRemotePath(l.Workspace, remotePath)
+
+		r := remote.NewResult(n.Name, remotePath)
+		var out bytes.Buffer
+		out.WriteString("------------------------------------------------\n")
+		out.WriteString(fmt.Sprintf("try to push a genesis. node : %s, path : %s\n", n.Name, remotePath))
+		defer func() {
+			if printer.Text() {
+				fmt.Println(out.String())
+			}
+		}()
+
+		c, err := createSSHClient(nodeCtx, opts, n)
+		if err != nil {
+			out.WriteString(fmt.Sprintf("failed to create a ssh client. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ClassifyConnectError(err), err)
+		}
+		defer c.Close()
+		stop := watchdog(nodeCtx, 0, func() { _ = c.Close() })
+		defer stop()
+
+		client, err := sftp.NewClient(c)
+		if err != nil {
+			out.WriteString(fmt.Sprintf("failed to create a sftp client. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ErrorSession, err)
+		}
+		err = writeRemoteFile(client, remotePath, content)
+		_ = client.Close()
+		if err != nil {
+			if reason := stop(); reason != nil {
+				out.WriteString(fmt.Sprintf("aborted to push a genesis. node %s, %v\n", n.Name, reason))
+				return r.Fail(remote.ClassifyRunError(reason), reason)
+			}
+			out.WriteString(fmt.Sprintf("failed to upload a genesis. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ErrorTransfer, err)
+		}
+		out.WriteString("uploaded a genesis\n")
+
+		// the hash of the pushed file is only known once init applied it. block 0 of a running
+		// node belongs to the chain it was initialized with, which may not be the pushed file
+		if !runInit {
+			return r.Done()
+		}
+		script, err := node.RenderScript(n, l, types.PhaseInit)
+		if err != nil {
+			return r.Fail(remote.ErrorConfig, err)
+		}
+		session, err := c.NewSession()
+		if err != nil {
+			return r.Fail(remote.ErrorSession, err)
+		}
+		var initOut syncBuffer
+		session.Stdout = &initOut
+		session.Stderr = &initOut
+		err = session.Start(script)
+		if err == nil {
+			err = waitSession(nodeCtx, session)
+		}
+		_ = session.Close()
+		r.Stderr = initOut.String()
+		if err != nil {
+			out.WriteString(fmt.Sprintf("failed to init. node %s, %v\n%s", n.Name, err, initOut.String()))
+			return r.Fail(remote.ClassifyRunError(err), err)
+		}
+		hash := genesis.ParseInitHash(initOut.String())
+		if hash == "" {
+			out.WriteString(initOut.String())
+			return r.Fail(remote.ErrorRemoteExit, errors.New("cannot find a genesis hash in the output of init"))
+		}
+		out.WriteString(fmt.Sprintf("genesis hash : %s\n", hash))
+		r.Stdout = hash
+		hashLock.Lock()
+		hashes[n.Name] = hash
+		hashLock.Unlock()
+		return r.Done()
+	}
+
+	results := new(remote.Collector)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+		results.Add(policy.Do(nodeCtx, func(attempt int) *remote.Result {
+			return push(nodeCtx, nodes[i])
+		}))
+	})
+
+	if printer.Text() {
+		success, fail := results.Summary()
+		fmt.Printf("## Complete to push a genesis. success nodes : %v / failures : %v\n", success, fail)
+		printCancelled(results)
+	} else if err := printer.Print(resultTable(results.Results())); err != nil {
+		return err
+	}
+	if len(hashes) > 0 {
+		if err := genesis.Verify(hashes); err != nil {
+			return err
+		}
+		if printer.Text() {
+			fmt.Printf("## Verified genesis hash of %d nodes\n", len(hashes))
+		}
+	} else if !runInit && printer.Text() {
+		fmt.Println("## Genesis hash is not verified. run with --init to apply the genesis and compare its hash")
+	}
+	return checkResults(ctx, results)
+}
+
+// saveAccount stores the account on the node record
+func saveAccount(n *types.Node, account string) error {
+	stored, err := node.GetNode(app.db, n.Name)
+	if err != nil {
+		return err
+	}
+	if stored.Account == account {
+		return nil
+	}
+	stored.Account = account
+	if err := node.SaveNode(app.db, stored); err != nil {
+		return err
+	}
+	n.Account = account
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/hostkey"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"sort"
+	"sync"
+	"time"
+)
+
+const scanTimeout = 10 * time.Second
+
+// sshFlags are flags of commands which connect to jump hosts of nodes
+var sshFlags = []cli.Flag{
+	utils.HostKeyPolicyFlag,
+	utils.KnownHostsFlag,
+	utils.ConnectTimeoutFlag,
+}
+
+var (
+	trustCommand = cli.Command{
+		Name:      "trust",
+		Usage:     "Pin the current host key of a node",
+		Action:    trustNode,
+		ArgsUsage: "<node name>",
+		Flags:     sshFlags,
+	}
+
+	keyscanCommand = cli.Command{
+		Name:      "keyscan",
+		Usage:     "Scan host keys of nodes and compare them with pinned keys",
+		Action:    keyscanNodes,
+		ArgsUsage: "[node names or empty if all]",
+		Flags: append([]cli.Flag{
+			utils.SelectorFlag,
+			utils.ParallelFlag,
+			utils.PinFlag,
+		}, append(sshFlags, outputFlags...)...),
+	}
+)
+
+// scanResult is a scanned host key of a node
+type scanResult struct {
+	Node        string `json:"node"`
+	Address     string `json:"address"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Status      string `json:"status"`
+	Error       string `json:"error,omitempty"`
+}
+
+// scanTable renders scan results as table rows
+type scanTable []*scanResult
+
+func (t scanTable) Header() []string {
+	return []string{"NODE", "ADDRESS", "FINGERPRINT", "STATUS", "ERROR"}
+}
+
+func (t scanTable) Rows() [][]string {
+	rows := make([][]string, 0, len(t))
+	for _, r := range t {
+		rows = append(rows, []string{r.Node, r.Address, r.Fingerprint, r.Status, r.Error})
+	}
+	return rows
+}
+
+// trustNode scans the host key of a node and pins it replacing the previous one
+func trustNode(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("node name must be given")
+	}
+	n, err := node.GetNode(app.db, ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	if n.Host == nil {
+		return errors.New("host of node " + n.Name + " is nil")
+	}
+
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	runCtx, cancel := signalContext()
+	defer cancel()
+	key, err := scanHostKey(runCtx, opts, n)
+	if err != nil {
+		return err
+	}
+	if n.Host.HostKey != "" {
+		if old, err := hostkey.Parse(n.Host.HostKey); err == nil && !hostkey.Equal(old, key) {
+			fmt.Printf("replacing pinned host key %s\n", hostkey.Fingerprint(old))
+		}
+	}
+	return pinHostKey(n, key)
+}
+
+// keyscanNodes scans host keys of nodes
+func keyscanNodes(ctx *cli.Context) error {
+	nodes, err := extractNodes(ctx)
+	if err != nil {
+		return err
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	var lock sync.Mutex
+	var results scanTable
+	pin := ctx.Bool(utils.PinFlag.Name)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		r := scanNode(runCtx, opts, nodes[i], pin)
+		lock.Lock()
+		defer lock.Unlock()
+		results = append(results, r)
+	})
+	sort.Slice(results, func(i, j int) bool {
+		return results[i].Node < results[j].Node
+	})
+
+	if printer.Text() {
+		for _, r := range results {
+			fmt.Printf("%s (%s) %s %s %s\n", r.Node, r.Address, r.Status, r.Fingerprint, r.Error)
+		}
+		return nil
+	}
+	return printer.Print(results)
+}
+
+// scanNode scans the host key of a node through its jump hosts and pins it if requested and not pinned yet
+func scanNode(ctx context.Context, opts *sshOptions, n *types.Node, pin bool) *scanResult {
+	r := &scanResult{Node: n.Name}
+	if n.Host == nil {
+		r.Status, r.Error = "error", "host is nil"
+		return r
+	}
+	r.Address = n.Host.Addr()
+
+	key, err := scanHostKey(ctx, opts, n)
+	if err != nil {
+		r.Status, r.Error = "error", err.Error()
+		return r
+	}
+	r.Fingerprint = hostkey.Fingerprint(key)
+
+	if n.Host.HostKey == "" {
+		r.Status = "unpinned"
+		if pin {
+			if err := pinHostKey(n, key); err != nil {
+				r.Error = err.Error()
+			} else {
+				r.Status = "pinned"
+			}
+		}
+		return r
+	}
+
+	pinned, err := hostkey.Parse(n.Host.HostKey)
+	switch {
+	case err != nil:
+		r.Status, r.Error = "error", err.Error()
+	case hostkey.Equal(pinned, key):
+		r.Status = "match"
+	default:
+		r.Status = "mismatch"
+	}
+	return r
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"log"
+)
+
+var (
+	lifecycleFlags = []cli.Flag{
+		utils.WorkspaceFlag,
+		utils.ScriptInitFlag,
+		utils.ScriptBuildFlag,
+		utils.ScriptStartFlag,
+		utils.ScriptStopFlag,
+	}
+
+	defaultsCommand = cli.Command{
+		Action: ShowSubCommand,
+		Name:   "defaults",
+		Usage:  "manage default workspace and lifecycle scripts of nodes",
+		Subcommands: []cli.Command{
+			{
+				Name:   "get",
+				Usage:  "Get defaults",
+				Action: displayDefaults,
+				Flags:  outputFlags,
+			},
+			{
+				Name:   "set",
+				Usage:  "Set defaults. empty values fall back to built-in defaults",
+				Action: setDefaults,
+				Flags:  lifecycleFlags,
+			},
+		},
+	}
+)
+
+// displayDefaults display the global lifecycle defaults
+func displayDefaults(ctx *cli.Context) error {
+	l, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	if !printer.Text() {
+		return printer.Print(l)
+	}
+	log.Printf("workspace : %s\n", l.Workspace)
+	for _, phase := range []string{types.PhaseInit, types.PhaseBuild, types.PhaseStart, types.PhaseStop} {
+		log.Printf("%s : %s\n", phase, l.Script(phase))
+	}
+	return nil
+}
+
+// setDefaults update the global lifecycle defaults with given flags
+func setDefaults(ctx *cli.Context) error {
+	l := parseLifecycle(ctx)
+	if l == nil {
+		l = &types.Lifecycle{}
+	}
+	if err := node.SaveLifecycleDefaults(app.db, l); err != nil {
+		return err
+	}
+	log.Println("success to save defaults")
+	return nil
+}
+
+// parseLifecycle extract a lifecycle from cli context. it returns nil if nothing is given
+func parseLifecycle(ctx *cli.Context) *types.Lifecycle {
+	l := &types.Lifecycle{
+		Workspace: ctx.String(utils.WorkspaceFlag.Name),
+		Init:      ctx.String(utils.ScriptInitFlag.Name),
+		Build:     ctx.String(utils.ScriptBuildFlag.Name),
+		Start:     ctx.String(utils.ScriptStartFlag.Name),
+		Stop:      ctx.String(utils.ScriptStopFlag.Name),
+	}
+	if *l == (types.Lifecycle{}) {
+		return nil
+	}
+	return l
+}
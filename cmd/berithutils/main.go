@@ -4,24 +4,56 @@ import (
 	"fmt"
 	"github.com/mesia777/berith-utils/db"
 	"github.com/mesia777/berith-utils/utils"
+	"github.com/mesia777/berith-utils/vault"
 	"github.com/urfave/cli"
-	"log"
 	"os"
 )
 
 type App struct {
-	cliApp *cli.App
-	db     *db.Database
+	cliApp     *cli.App
+	db         db.Store
+	storeKind  string
+	backupKeep int
+	vault      *vault.Vault
 }
 
 var (
 	app = &App{
 		cliApp: utils.NewApp(),
-		db:     createDatabase(),
 	}
 )
 
 func init() {
+	app.cliApp.Flags = []cli.Flag{
+		utils.StoreFlag,
+		utils.BackupKeepFlag,
+	}
+	app.cliApp.Before = func(ctx *cli.Context) error {
+		app.storeKind = ctx.GlobalString(utils.StoreFlag.Name)
+		app.backupKeep = ctx.GlobalInt(utils.BackupKeepFlag.Name)
+		// db verify opens the store itself since a corrupted leveldb store does not open
+		if args := ctx.Args(); args.First() == dbCommand.Name && args.Get(1) == "verify" {
+			return nil
+		}
+		store, err := createStore(app.storeKind)
+		if err != nil {
+			return fmt.Errorf("failed to create data store. %v", err)
+		}
+		app.db = store
+		// db commands inspect and migrate the store themselves
+		if ctx.Args().First() != dbCommand.Name {
+			if err := migrateStore(store); err != nil {
+				return err
+			}
+		}
+		v, err := vault.New(store, utils.ReadPassphrase)
+		if err != nil {
+			return fmt.Errorf("failed to open vault. %v", err)
+		}
+		app.vault = v
+		return nil
+	}
+
 	app.cliApp.Action = func(ctx *cli.Context) error {
 		return cli.ShowAppHelp(ctx)
 	}
@@ -29,12 +61,15 @@ func init() {
 	app.cliApp.Commands = []cli.Command{
 		nodeCommand,
 		berithCommand,
+		dbCommand,
 	}
 }
 
 func main() {
 	err := app.cliApp.Run(os.Args)
-	defer app.db.Close()
+	if app.db != nil {
+		_ = app.db.Close()
+	}
 	if err != nil {
 		_, _ = fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -46,17 +81,26 @@ func ShowSubCommand(ctx *cli.Context) error {
 	return cli.ShowSubcommandHelp(ctx)
 }
 
-// createDataStore create a database
-func createDatabase() *db.Database {
-	path, err := utils.GetDatabasePath()
-	if err != nil {
-		log.Fatal("failed to create data store.", err)
-		os.Exit(1)
+// createStore opens a store given its kind. leveldb opens the database in the workspace,
+// memory keeps nothing after exit and a .json, .yaml or .yml path opens a single file store.
+func createStore(kind string) (db.Store, error) {
+	switch kind {
+	case "", "leveldb":
+		path, err := utils.GetDatabasePath()
+		if err != nil {
+			return nil, err
+		}
+		database, err := db.NewDatabase(path, nil)
+		if err != nil {
+			return nil, err
+		}
+		return database, nil
+	case "memory":
+		return db.NewMemoryStore(), nil
 	}
-	database, err := db.NewDatabase(path, nil)
+	store, err := db.NewFileStore(kind)
 	if err != nil {
-		log.Fatal("failed to create data store.", err)
-		os.Exit(1)
+		return nil, err
 	}
-	return database
+	return store, nil
 }
@@ -3,13 +3,16 @@ package main
 import (
 	"encoding/json"
 	"errors"
+	"fmt"
 	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/selector"
 	"github.com/mesia777/berith-utils/types"
 	"github.com/mesia777/berith-utils/utils"
 	"github.com/urfave/cli"
 	"io/ioutil"
 	"log"
 	"os"
+	"strings"
 )
 
 var (
@@ -20,9 +23,15 @@ var (
 		utils.HostPortFlag,
 		utils.HostPasswordFlag,
 		utils.HostKeyPathFlag,
+		utils.HostKeyPassphraseFlag,
+		utils.HostAuthFlag,
 		utils.HostDescriptionFlag,
+		utils.HostJumpFlag,
+		utils.NodeLabelFlag,
 	}
 
+	nodeEditFlags = append(append([]cli.Flag{}, nodeFlags...), lifecycleFlags...)
+
 	nodeCommand = cli.Command{
 		Action:   ShowSubCommand,
 		Name:     "node",
@@ -35,31 +44,32 @@ var (
 				Action: importNodes,
 				Flags: []cli.Flag{
 					utils.PathFlag,
+					utils.BestEffortFlag,
 				},
 			},
 			{
 				Name:   "add",
 				Usage:  "Adds a node",
 				Action: addNode,
-				Flags:  nodeFlags,
+				Flags:  nodeEditFlags,
 			},
 			{
 				Name:   "get",
 				Usage:  "Get a node",
 				Action: displayNode,
-				Flags:  nodeFlags,
+				Flags:  append(outputFlags, nodeFlags...),
 			},
 			{
 				Name:   "gets",
 				Usage:  "Get nodes",
 				Action: displayNodes,
-				Flags:  nodeFlags,
+				Flags:  append(append([]cli.Flag{utils.SelectorFlag}, outputFlags...), nodeFlags...),
 			},
 			{
 				Name:   "update",
-				Usage:  "Update a node",
+				Usage:  "Update only the given fields of a node",
 				Action: updateNode,
-				Flags:  nodeFlags,
+				Flags:  append([]cli.Flag{utils.NewNameFlag, utils.RevisionFlag}, nodeEditFlags...),
 			},
 			{
 				Name:   "delete",
@@ -67,6 +77,10 @@ var (
 				Action: deleteNode,
 				Flags:  nodeFlags,
 			},
+			vaultCommand,
+			defaultsCommand,
+			trustCommand,
+			keyscanCommand,
 		},
 	}
 )
@@ -95,11 +109,27 @@ func importNodes(ctx *cli.Context) error {
 		return err
 	}
 
+	warnPlainSecrets()
+	for _, n := range nodes {
+		if err = app.vault.Seal(n.Host); err != nil {
+			return err
+		}
+	}
+
+	if !ctx.Bool(utils.BestEffortFlag.Name) {
+		if err := node.AddNodes(app.db, nodes); err != nil {
+			return fmt.Errorf("nothing is imported. %v", err)
+		}
+		log.Printf("import hosts result >> imported : %d\n", len(nodes))
+		return nil
+	}
+
 	var failures []string
 	for _, n := range nodes {
 		err = node.AddNode(app.db, n)
 
 		if err != nil {
+			log.Printf("failed to import node %s. %v\n", n.Name, err)
 			failures = append(failures, n.Name)
 			continue
 		}
@@ -115,6 +145,10 @@ func addNode(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	warnPlainSecrets()
+	if err := app.vault.Seal(n.Host); err != nil {
+		return err
+	}
 	return node.AddNode(app.db, n)
 }
 
@@ -132,15 +166,37 @@ func displayNode(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	if !printer.Text() {
+		return printer.Print(nodeView{maskSecrets(n)})
+	}
 	displayNode0(n)
 	return nil
 }
 
 // displayNodes display all nodes in local store
 func displayNodes(ctx *cli.Context) error {
-	nodes, err := node.GetNodes(app.db)
+	sel, err := selector.Parse(ctx.String(utils.SelectorFlag.Name))
 	if err != nil {
-		return nil
+		return err
+	}
+	nodes, err := node.SelectNodes(app.db, nil, sel)
+	if err != nil {
+		return err
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	if !printer.Text() {
+		masked := make(nodeTable, 0, len(nodes))
+		for _, n := range nodes {
+			masked = append(masked, maskSecrets(n))
+		}
+		return printer.Print(masked)
 	}
 	displayNode0(nodes...)
 	return nil
@@ -154,7 +210,7 @@ func displayNode0(nodes ...*types.Node) {
 	}
 
 	for i, n := range nodes {
-		s, err := json.Marshal(n)
+		s, err := json.Marshal(maskSecrets(n))
 		if err != nil {
 			log.Printf("%v -> %s\n", i+1, n.Name)
 		} else {
@@ -163,13 +219,80 @@ func displayNode0(nodes ...*types.Node) {
 	}
 }
 
-// updateNode update a node
+// updateNode update flags which are set on a node
 func updateNode(ctx *cli.Context) error {
-	n, err := parseNode(ctx)
+	patch, err := parsePatch(ctx)
 	if err != nil {
 		return err
 	}
-	return node.UpdateNode(app.db, n)
+	if patch.Password != nil || patch.KeyPassphrase != nil {
+		warnPlainSecrets()
+	}
+	_, err = node.UpdateNode(app.db, patch)
+	return err
+}
+
+// parsePatch extract a patch of flags which are set in cli context. Secrets are sealed
+func parsePatch(ctx *cli.Context) (*node.Patch, error) {
+	patch := &node.Patch{
+		Name:     ctx.String(utils.NodeNameFlag.Name),
+		Revision: ctx.Uint64(utils.RevisionFlag.Name),
+		NewName:  ctx.String(utils.NewNameFlag.Name),
+	}
+	if patch.Name == "" {
+		return nil, errors.New("name of a node must be given")
+	}
+	optString := func(flag cli.StringFlag) *string {
+		if !ctx.IsSet(flag.Name) {
+			return nil
+		}
+		v := ctx.String(flag.Name)
+		return &v
+	}
+	patch.User = optString(utils.HostUserFlag)
+	patch.Address = optString(utils.HostAddressFlag)
+	patch.KeyPath = optString(utils.HostKeyPathFlag)
+	patch.Description = optString(utils.HostDescriptionFlag)
+	if ctx.IsSet(utils.HostPortFlag.Name) {
+		port := ctx.Int(utils.HostPortFlag.Name)
+		patch.Port = &port
+	}
+	if ctx.IsSet(utils.HostAuthFlag.Name) {
+		patch.Auth = ctx.StringSlice(utils.HostAuthFlag.Name)
+	}
+	if ctx.IsSet(utils.HostJumpFlag.Name) {
+		patch.Jump = []*types.Jump{}
+		for _, name := range ctx.StringSlice(utils.HostJumpFlag.Name) {
+			patch.Jump = append(patch.Jump, &types.Jump{Node: name})
+		}
+	}
+	if ctx.IsSet(utils.NodeLabelFlag.Name) {
+		labels, err := parseLabels(ctx.StringSlice(utils.NodeLabelFlag.Name))
+		if err != nil {
+			return nil, err
+		}
+		patch.Labels = labels
+	}
+	patch.Lifecycle = parseLifecycle(ctx)
+
+	// seal given secrets alone so that unchanged ones stay as stored
+	secrets := &types.Host{}
+	if patch.Password = optString(utils.HostPasswordFlag); patch.Password != nil {
+		secrets.Password = *patch.Password
+	}
+	if patch.KeyPassphrase = optString(utils.HostKeyPassphraseFlag); patch.KeyPassphrase != nil {
+		secrets.KeyPassphrase = *patch.KeyPassphrase
+	}
+	if err := app.vault.Seal(secrets); err != nil {
+		return nil, err
+	}
+	if patch.Password != nil {
+		patch.Password = &secrets.Password
+	}
+	if patch.KeyPassphrase != nil {
+		patch.KeyPassphrase = &secrets.KeyPassphrase
+	}
+	return patch, nil
 }
 
 // deleteNode delete a node
@@ -178,21 +301,73 @@ func deleteNode(ctx *cli.Context) error {
 	if err != nil {
 		return err
 	}
+	if err := autoBackup(app.db, "delete"); err != nil {
+		return err
+	}
 	return node.DeleteHost(app.db, n.Name)
 }
 
 // parseNode extract node from cli context
 func parseNode(ctx *cli.Context) (*types.Node, error) {
 	host := &types.Host{
-		User:        ctx.String(utils.HostUserFlag.Name),
-		Address:     ctx.String(utils.HostAddressFlag.Name),
-		Port:        ctx.Int(utils.HostPortFlag.Name),
-		Password:    ctx.String(utils.HostPasswordFlag.Name),
-		KeyPath:     ctx.String(utils.HostKeyPathFlag.Name),
-		Description: ctx.String(utils.HostDescriptionFlag.Name),
+		User:          ctx.String(utils.HostUserFlag.Name),
+		Address:       ctx.String(utils.HostAddressFlag.Name),
+		Port:          ctx.Int(utils.HostPortFlag.Name),
+		Password:      ctx.String(utils.HostPasswordFlag.Name),
+		KeyPath:       ctx.String(utils.HostKeyPathFlag.Name),
+		KeyPassphrase: ctx.String(utils.HostKeyPassphraseFlag.Name),
+		Auth:          ctx.StringSlice(utils.HostAuthFlag.Name),
+		Description:   ctx.String(utils.HostDescriptionFlag.Name),
+	}
+	for _, name := range ctx.StringSlice(utils.HostJumpFlag.Name) {
+		host.Jump = append(host.Jump, &types.Jump{Node: name})
+	}
+	labels, err := parseLabels(ctx.StringSlice(utils.NodeLabelFlag.Name))
+	if err != nil {
+		return nil, err
 	}
 	return &types.Node{
-		Name: ctx.String(utils.NodeNameFlag.Name),
-		Host: host,
+		Name:      ctx.String(utils.NodeNameFlag.Name),
+		Host:      host,
+		Labels:    labels,
+		Lifecycle: parseLifecycle(ctx),
 	}, nil
 }
+
+// parseLabels parses key=value pairs into labels. it returns nil if empty
+func parseLabels(pairs []string) (map[string]string, error) {
+	if len(pairs) == 0 {
+		return nil, nil
+	}
+	labels := make(map[string]string, len(pairs))
+	for _, pair := range pairs {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, errors.New("invalid label " + pair + ". must be key=value")
+		}
+		labels[kv[0]] = kv[1]
+	}
+	return labels, nil
+}
+
+// maskSecrets returns a copy of the node without secret values for display
+func maskSecrets(n *types.Node) *types.Node {
+	if n.Host == nil {
+		return n
+	}
+	masked := *n
+	masked.Host = n.Host.Copy()
+	for _, s := range masked.Host.Secrets() {
+		if *s != "" {
+			*s = "******"
+		}
+	}
+	return &masked
+}
+
+// warnPlainSecrets warns that secrets are stored in plain text without a vault
+func warnPlainSecrets() {
+	if !app.vault.Initialized() {
+		log.Println("WARN: vault is not initialized, secrets are stored in plain text. run `node vault init`")
+	}
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mesia777/berith-utils/consensus"
+	"github.com/mesia777/berith-utils/output"
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/tunnel"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var outputFlags = []cli.Flag{
+	utils.OutputFlag,
+	utils.TemplateFlag,
+}
+
+// newPrinter returns a printer given output flags
+func newPrinter(ctx *cli.Context) (*output.Printer, error) {
+	return output.NewPrinter(ctx.String(utils.OutputFlag.Name), ctx.String(utils.TemplateFlag.Name), os.Stdout)
+}
+
+// nodeTable renders nodes as table rows
+type nodeTable []*types.Node
+
+func (t nodeTable) Header() []string {
+	return []string{"NAME", "USER", "ADDRESS", "PORT", "LABELS", "DESCRIPTION"}
+}
+
+func (t nodeTable) Rows() [][]string {
+	rows := make([][]string, 0, len(t))
+	for _, n := range t {
+		h := n.Host
+		if h == nil {
+			h = &types.Host{}
+		}
+		rows = append(rows, []string{n.Name, h.User, h.Address, strconv.Itoa(h.Port), formatLabels(n.Labels), h.Description})
+	}
+	return rows
+}
+
+// nodeView renders a single node as it is, or as a table with one row
+type nodeView struct {
+	*types.Node
+}
+
+func (v nodeView) Header() []string {
+	return nodeTable{v.Node}.Header()
+}
+
+func (v nodeView) Rows() [][]string {
+	return nodeTable{v.Node}.Rows()
+}
+
+// resultTable renders results as table rows
+type resultTable []*remote.Result
+
+func (t resultTable) Header() []string {
+	return []string{"NODE", "STATUS", "EXIT", "ATTEMPTS", "DURATION", "ERROR"}
+}
+
+func (t resultTable) Rows() [][]string {
+	rows := make([][]string, 0, len(t))
+	for _, r := range t {
+		status := "ok"
+		if r.Failed() {
+			status = string(r.ErrorClass)
+		}
+		rows = append(rows, []string{r.Node, status, strconv.Itoa(r.ExitStatus), strconv.Itoa(r.Attempts), r.Duration.String(), r.Error})
+	}
+	return rows
+}
+
+// statusTable renders json-rpc status of nodes as table rows
+type statusTable []*nodeStatus
+
+func (t statusTable) Header() []string {
+	return []string{"NODE", "STATUS", "BLOCK", "PEERS", "SYNCING", "CLIENT", "COINBASE", "ERROR"}
+}
+
+func (t statusTable) Rows() [][]string {
+	rows := make([][]string, 0, len(t))
+	for _, n := range t {
+		if n.Status == nil {
+			rows = append(rows, []string{n.Node, string(n.ErrorClass), "-", "-", "-", "-", "-", n.Error})
+			continue
+		}
+		s := n.Status
+		syncing := "no"
+		if s.Syncing {
+			syncing = fmt.Sprintf("%d/%d", s.CurrentBlock, s.HighestBlock)
+		}
+		rows = append(rows, []string{n.Node, "ok", strconv.FormatUint(s.BlockNumber, 10), strconv.FormatUint(s.Peers, 10), syncing, s.ClientVersion, s.Coinbase, n.Error})
+	}
+	return rows
+}
+
+// forkTable renders heads of nodes and their forks as table rows
+type forkTable []*consensus.NodeState
+
+func (t forkTable) Header() []string {
+	return []string{"NODE", "FORK", "HEAD", "BEHIND", "HASH"}
+}
+
+func (t forkTable) Rows() [][]string {
+	rows := make([][]string, 0, len(t))
+	for _, n := range t {
+		rows = append(rows, []string{n.Node, strconv.Itoa(n.Fork), strconv.FormatUint(n.Head, 10), strconv.FormatUint(n.Behind, 10), n.Hash})
+	}
+	return rows
+}
+
+// mappingTable renders forwards of tunnels as table rows
+type mappingTable []*tunnel.Mapping
+
+func (t mappingTable) Header() []string {
+	return []string{"NODE", "LOCAL", "REMOTE"}
+}
+
+func (t mappingTable) Rows() [][]string {
+	rows := make([][]string, 0, len(t))
+	for _, m := range t {
+		rows = append(rows, []string{m.Node, m.Local, m.Remote})
+	}
+	return rows
+}
+
+// formatLabels returns labels as sorted key=value pairs
+func formatLabels(labels map[string]string) string {
+	pairs := make([]string, 0, len(labels))
+	for k, v := range labels {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/peers"
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/rpc"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/pkg/sftp"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"path"
+	"strings"
+	"sync"
+)
+
+var (
+	peersCommand = cli.Command{
+		Action: ShowSubCommand,
+		Name:   "peers",
+		Usage:  "manage static peers of nodes",
+		Subcommands: []cli.Command{
+			{
+				Name:      "sync",
+				Usage:     "gather enode urls of nodes and upload static-nodes.json of the topology to each node",
+				Action:    syncPeers,
+				ArgsUsage: "[node names or empty if all]",
+				Flags: append([]cli.Flag{
+					utils.TopologyFlag,
+					utils.StaticNodesFlag,
+					utils.EnodeExecFlag,
+					utils.AddPeerFlag,
+					utils.DryRunFlag,
+					utils.RPCFlag,
+					utils.RPCDirectFlag,
+				}, berithFlags...),
+			},
+		},
+	}
+)
+
+// syncPeers gather enodes of nodes, then upload static-nodes.json to each node given cli context
+func syncPeers(ctx *cli.Context) error {
+	nodes, err := extractNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("empty nodes to sync peers")
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := newRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	defaults, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+	dryRun := ctx.Bool(utils.DryRunFlag.Name)
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	// gather enodes
+	var enodeLock sync.Mutex
+	enodes := make(map[string]string, len(nodes))
+	gather := func(nodeCtx context.Context, n *types.Node) *remote.Result {
+		r := remote.NewResult(n.Name, "")
+		c, err := createSSHClient(nodeCtx, opts, n)
+		if err != nil {
+			return r.Fail(remote.ClassifyConnectError(err), err)
+		}
+		defer c.Close()
+		stop := watchdog(nodeCtx, 0, func() { _ = c.Close() })
+		defer stop()
+
+		source, enode, err := queryValue(nodeCtx, ctx, n, node.ResolveLifecycle(n, defaults), c, ctx.String(utils.EnodeExecFlag.Name),
+			func(client *rpc.Client) (string, error) {
+				info, err := client.NodeInfo(nodeCtx)
+				if err != nil {
+					return "", err
+				}
+				return info.Enode, nil
+			})
+		r.Command = source
+		if reason := stop(); reason != nil {
+			return r.Fail(remote.ClassifyRunError(reason), reason)
+		}
+		if err != nil {
+			return r.Fail(remote.ClassifyRunError(err), fmt.Errorf("failed to get an enode. %v", err))
+		}
+
+		enode, err = peers.RewriteHost(enode, n.Host.Address)
+		if err != nil {
+			return r.Fail(remote.ErrorRPC, err)
+		}
+		r.Stdout = enode
+		if !dryRun {
+			if err := saveEnode(n, enode); err != nil {
+				log.Printf("failed to store an enode of node %s. %v\n", n.Name, err)
+			}
+		}
+		enodeLock.Lock()
+		enodes[n.Name] = enode
+		enodeLock.Unlock()
+		return r.Done()
+	}
+
+	results := new(remote.Collector)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+		r := policy.Do(nodeCtx, func(attempt int) *remote.Result {
+			return gather(nodeCtx, nodes[i])
+		})
+		if !r.Failed() {
+			return
+		}
+		// fall back to the enode stored by a previous sync
+		if nodes[i].Enode != "" {
+			log.Printf("failed to get an enode of node %s. use the stored one. reason(%s): %s\n", r.Node, r.ErrorClass, r.Error)
+			enodeLock.Lock()
+			enodes[nodes[i].Name] = nodes[i].Enode
+			enodeLock.Unlock()
+			return
+		}
+		if printer.Text() {
+			fmt.Printf("## failed to get an enode of node %s%s. reason(%s): %s\n", r.Node, attempts(r), r.ErrorClass, r.Error)
+		}
+		results.Add(r)
+	})
+
+	// distribute static nodes
+	var members []*types.Node
+	var names []string
+	for _, n := range nodes {
+		if _, ok := enodes[n.Name]; ok {
+			members = append(members, n)
+			names = append(names, n.Name)
+		}
+	}
+	if len(members) == 0 {
+		return results.Err()
+	}
+	topology, err := peers.Topology(ctx.String(utils.TopologyFlag.Name), names)
+	if err != nil {
+		return err
+	}
+
+	distribute := func(nodeCtx context.Context, n *types.Node) *remote.Result {
+		var peerEnodes []string
+		for _, peer := range topology[n.Name] {
+			peerEnodes = append(peerEnodes, enodes[peer])
+		}
+		content, err := peers.StaticNodes(peerEnodes)
+		if err != nil {
+			return remote.NewResult(n.Name, "").Fail(remote.ErrorConfig, err)
+		}
+		l := node.ResolveLifecycle(n, defaults)
+		remotePath, err := node.Render(n, l, ctx.String(utils.StaticNodesFlag.Name))
+		if err != nil {
+			return remote.NewResult(n.Name, "").Fail(remote.ErrorConfig, err)
+		}
+		remotePath = node.ResolveRemotePath(l.Workspace, remotePath)
+
+		r := remote.NewResult(n.Name, remotePath)
+		var out bytes.Buffer
+		out.WriteString("------------------------------------------------\n")
+		out.WriteString(fmt.Sprintf("try to upload static nodes. node : %s, path : %s, peers : %v\n", n.Name, remotePath, topology[n.Name]))
+		defer func() {
+			if printer.Text() {
+				fmt.Println(out.String())
+			}
+		}()
+		if dryRun {
+			out.Write(content)
+			return r.Done()
+		}
+
+		c, err := createSSHClient(nodeCtx, opts, n)
+		if err != nil {
+			out.WriteString(fmt.Sprintf("failed to create a ssh client. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ClassifyConnectError(err), err)
+		}
+		defer c.Close()
+		stop := watchdog(nodeCtx, 0, func() { _ = c.Close() })
+		defer stop()
+
+		client, err := sftp.NewClient(c)
+		if err != nil {
+			out.WriteString(fmt.Sprintf("failed to create a sftp client. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ErrorSession, err)
+		}
+		defer client.Close()
+		if err := writeRemoteFile(client, remotePath, content); err != nil {
+			if reason := stop(); reason != nil {
+				out.WriteString(fmt.Sprintf("aborted to upload static nodes. node %s, %v\n", n.Name, reason))
+				return r.Fail(remote.ClassifyRunError(reason), reason)
+			}
+			out.WriteString(fmt.Sprintf("failed to upload static nodes. node %s, %v\n", n.Name, err))
+			return r.Fail(remote.ErrorTransfer, err)
+		}
+		out.WriteString(fmt.Sprintf("uploaded %d peers\n", len(peerEnodes)))
+
+		if ctx.Bool(utils.AddPeerFlag.Name) {
+			rpcClient, err := rpcClientOf(ctx, n, l, c)
+			if err != nil {
+				return r.Fail(remote.ErrorConfig, err)
+			}
+			for _, enode := range peerEnodes {
+				if err := rpcClient.AddPeer(nodeCtx, enode); err != nil {
+					if reason := stop(); reason != nil {
+						return r.Fail(remote.ClassifyRunError(reason), reason)
+					}
+					out.WriteString(fmt.Sprintf("failed to add a peer %s. %v\n", enode, err))
+					return r.Fail(remote.ErrorRPC, err)
+				}
+			}
+			out.WriteString(fmt.Sprintf("added %d peers\n", len(peerEnodes)))
+		}
+		if reason := stop(); reason != nil {
+			return r.Fail(remote.ClassifyRunError(reason), reason)
+		}
+		return r.Done()
+	}
+
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(members), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+		results.Add(policy.Do(nodeCtx, func(attempt int) *remote.Result {
+			return distribute(nodeCtx, members[i])
+		}))
+	})
+
+	if printer.Text() {
+		success, fail := results.Summary()
+		fmt.Printf("## Complete to sync peers. success nodes : %v / failures : %v\n", success, fail)
+		printCancelled(results)
+	} else if err := printer.Print(resultTable(results.Results())); err != nil {
+		return err
+	}
+	return checkResults(ctx, results)
+}
+
+// queryValue returns the output of the command rendered from the exec template if given,
+// otherwise the value returned by the json-rpc call. The command or the endpoint is also returned.
+func queryValue(nodeCtx context.Context, ctx *cli.Context, n *types.Node, l *types.Lifecycle, c *ssh.Client, execTmpl string, call func(client *rpc.Client) (string, error)) (string, string, error) {
+	if execTmpl != "" {
+		cmd, err := node.Render(n, l, execTmpl)
+		if err != nil {
+			return "", "", remote.WithClass(remote.ErrorConfig, err)
+		}
+		value, err := execOutput(c, cmd)
+		return cmd, value, err
+	}
+	client, err := rpcClientOf(ctx, n, l, c)
+	if err != nil {
+		return "", "", remote.WithClass(remote.ErrorConfig, err)
+	}
+	value, err := call(client)
+	return client.URL, value, remote.WithClass(remote.ErrorRPC, err)
+}
+
+// execOutput runs a command on the client and returns its trimmed output without quotes
+func execOutput(c *ssh.Client, cmd string) (string, error) {
+	session, err := c.NewSession()
+	if err != nil {
+		return "", err
+	}
+	defer session.Close()
+	out, err := session.Output(cmd)
+	if err != nil {
+		return "", err
+	}
+	return strings.Trim(strings.TrimSpace(string(out)), `"`), nil
+}
+
+// writeRemoteFile writes content to a remote file, creating its parent directories
+func writeRemoteFile(client *sftp.Client, remotePath string, content []byte) error {
+	if err := client.MkdirAll(path.Dir(remotePath)); err != nil {
+		return err
+	}
+	f, err := client.Create(remotePath)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(content); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// saveEnode stores the enode on the node record
+func saveEnode(n *types.Node, enode string) error {
+	stored, err := node.GetNode(app.db, n.Name)
+	if err != nil {
+		return err
+	}
+	if stored.Enode == enode {
+		return nil
+	}
+	stored.Enode = enode
+	if err := node.SaveNode(app.db, stored); err != nil {
+		return err
+	}
+	n.Enode = enode
+	return nil
+}
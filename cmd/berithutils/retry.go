@@ -0,0 +1,37 @@
+package main
+
+import (
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/retry"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"log"
+	"time"
+)
+
+// newRetryPolicy returns a retry policy given cli context
+func newRetryPolicy(ctx *cli.Context) (*retry.Policy, error) {
+	retryable := retry.DefaultRetryable
+	if classes := ctx.StringSlice(utils.RetryOnFlag.Name); len(classes) > 0 {
+		parsed, err := retry.ParseClasses(classes)
+		if err != nil {
+			return nil, err
+		}
+		retryable = parsed
+	}
+
+	policy := &retry.Policy{
+		Attempts:   ctx.Int(utils.RetryAttemptsFlag.Name),
+		Backoff:    ctx.Duration(utils.RetryBackoffFlag.Name),
+		MaxBackoff: ctx.Duration(utils.RetryMaxBackoffFlag.Name),
+		Jitter:     ctx.Float64(utils.RetryJitterFlag.Name),
+		Retryable:  retryable,
+		OnRetry: func(r *remote.Result, attempt int, delay time.Duration) {
+			log.Printf("attempt %d of node %s failed. reason(%s): %s. retry in %v\n", attempt, r.Node, r.ErrorClass, r.Error, delay.Round(time.Millisecond))
+		},
+	}
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	return policy, nil
+}
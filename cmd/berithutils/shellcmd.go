@@ -0,0 +1,102 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+)
+
+var (
+	shellCommand = cli.Command{
+		Name:      "ssh",
+		Usage:     "open an interactive shell on a node with the stored credentials",
+		Action:    openShell,
+		ArgsUsage: "<node name>",
+		Flags: []cli.Flag{
+			utils.HostKeyPolicyFlag,
+			utils.KnownHostsFlag,
+			utils.ConnectTimeoutFlag,
+		},
+	}
+)
+
+// openShell opens an interactive pty session on a node given cli context
+func openShell(ctx *cli.Context) error {
+	if ctx.NArg() != 1 {
+		return errors.New("a node name must be given")
+	}
+	n, err := node.GetNode(app.db, ctx.Args().First())
+	if err != nil {
+		return err
+	}
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return errors.New("cannot open a shell. stdin is not a terminal")
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+
+	// signals only abort connecting. once in raw mode, Ctrl-C is sent to the remote shell
+	dialCtx, cancel := signalContext()
+	client, err := createSSHClient(dialCtx, opts, n)
+	cancel()
+	if err != nil {
+		return fmt.Errorf("failed to create a ssh client. node %s, %v", n.Name, err)
+	}
+	defer client.Close()
+
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("failed to create a session. node %s, %v", n.Name, err)
+	}
+	defer session.Close()
+
+	width, height, err := terminal.GetSize(fd)
+	if err != nil {
+		width, height = 80, 24
+	}
+	term := os.Getenv("TERM")
+	if term == "" {
+		term = "xterm-256color"
+	}
+	modes := ssh.TerminalModes{
+		ssh.ECHO:          1,
+		ssh.TTY_OP_ISPEED: 14400,
+		ssh.TTY_OP_OSPEED: 14400,
+	}
+	if err := session.RequestPty(term, height, width, modes); err != nil {
+		return fmt.Errorf("failed to request a pty. node %s, %v", n.Name, err)
+	}
+	session.Stdin = os.Stdin
+	session.Stdout = os.Stdout
+	session.Stderr = os.Stderr
+
+	state, err := terminal.MakeRaw(fd)
+	if err != nil {
+		return fmt.Errorf("failed to set the terminal to raw mode. %v", err)
+	}
+	defer func() {
+		_ = terminal.Restore(fd, state)
+	}()
+	stop := watchWindowSize(fd, session)
+	defer stop()
+
+	if err := session.Shell(); err != nil {
+		return fmt.Errorf("failed to start a shell. node %s, %v", n.Name, err)
+	}
+	err = session.Wait()
+	if exit, ok := err.(*ssh.ExitError); ok {
+		return fmt.Errorf("shell of node %s exited with status %d", n.Name, exit.ExitStatus())
+	}
+	if _, ok := err.(*ssh.ExitMissingError); ok {
+		return nil
+	}
+	return err
+}
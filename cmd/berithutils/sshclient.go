@@ -0,0 +1,477 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/hostkey"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sshOptions are connection options shared by all ssh clients of a command
+type sshOptions struct {
+	hostKeys       *hostkey.Verifier
+	connectTimeout time.Duration
+}
+
+// newSSHOptions returns ssh options given cli context
+func newSSHOptions(ctx *cli.Context) (*sshOptions, error) {
+	policy, err := hostkey.ParsePolicy(ctx.String(utils.HostKeyPolicyFlag.Name))
+	if err != nil {
+		return nil, err
+	}
+	knownHosts := ctx.String(utils.KnownHostsFlag.Name)
+	if knownHosts == "" {
+		knownHosts = utils.GetKnownHostsPath()
+	}
+	return &sshOptions{
+		hostKeys: &hostkey.Verifier{
+			Policy:     policy,
+			KnownHosts: []string{knownHosts},
+		},
+		connectTimeout: ctx.Duration(utils.ConnectTimeoutFlag.Name),
+	}, nil
+}
+
+// dialJumps connects to the last jump host of the target through the ones before it.
+// It returns nil if the target has no jump host. path includes the target.
+func dialJumps(ctx context.Context, opts *sshOptions, target *hop, path []string) (*ssh.Client, error) {
+	var via *ssh.Client
+	for i, j := range target.host.Jump {
+		next, err := resolveJump(j)
+		if err != nil {
+			closeClient(via)
+			return nil, remote.WithClass(remote.ErrorConfig, err)
+		}
+		var c *ssh.Client
+		if i == 0 {
+			c, err = dialChain(ctx, opts, next, path)
+		} else {
+			c, err = dialHop(ctx, opts, via, next)
+		}
+		if err != nil {
+			closeClient(via)
+			return nil, remote.WithClass(remote.ClassifyConnectError(err), fmt.Errorf("failed to connect jump host %s. %v", next.name, err))
+		}
+		via = c
+	}
+
+	return via, nil
+}
+
+// scanHostKey returns the host key presented by a node without authenticating, through its jump hosts.
+func scanHostKey(ctx context.Context, opts *sshOptions, n *types.Node) (ssh.PublicKey, error) {
+	timeout := opts.connectTimeout
+	if timeout <= 0 {
+		timeout = scanTimeout
+	}
+	target := &hop{name: n.Name, node: n, host: n.Host}
+	via, err := dialJumps(ctx, opts, target, []string{n.Name})
+	if err != nil {
+		return nil, err
+	}
+	if via == nil {
+		return hostkey.Scan(n.Host.Addr(), timeout)
+	}
+	defer via.Close()
+	conn, err := via.Dial("tcp", n.Host.Addr())
+	if err != nil {
+		return nil, fmt.Errorf("failed to dial %s through jump hosts. %v", n.Host.Addr(), err)
+	}
+	return hostkey.ScanConn(conn, n.Host.Addr(), timeout)
+}
+
+// maxJumps limits the depth of nested jump hosts
+const maxJumps = 8
+
+// hop is a host to connect to. node is nil for inline jump hosts
+type hop struct {
+	name string
+	node *types.Node
+	host *types.Host
+}
+
+// createSSHClient create a ssh client given node, tunneling through its jump hosts.
+// Connecting is aborted when the context is done.
+func createSSHClient(ctx context.Context, opts *sshOptions, n *types.Node) (*ssh.Client, error) {
+	if n.Host == nil {
+		return nil, remote.WithClass(remote.ErrorConfig, errors.New("cannot create a ssh client. host is nil"))
+	}
+	if ctx.Err() != nil {
+		return nil, remote.ContextError(ctx)
+	}
+	return dialChain(ctx, opts, &hop{name: n.Name, node: n, host: n.Host}, nil)
+}
+
+// dialChain connects to the first jump host with its own jump hosts,
+// then to every following hop through the previous one and finally to the target
+func dialChain(ctx context.Context, opts *sshOptions, target *hop, path []string) (*ssh.Client, error) {
+	for _, name := range path {
+		if name == target.name {
+			return nil, remote.WithClass(remote.ErrorConfig, fmt.Errorf("jump host cycle : %s -> %s", strings.Join(path, " -> "), target.name))
+		}
+	}
+	path = append(path, target.name)
+	if len(path) > maxJumps {
+		return nil, remote.WithClass(remote.ErrorConfig, fmt.Errorf("too many jump hosts : %s", strings.Join(path, " -> ")))
+	}
+
+	via, err := dialJumps(ctx, opts, target, path)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dialHop(ctx, opts, via, target)
+	if err != nil {
+		closeClient(via)
+		return nil, err
+	}
+	return client, nil
+}
+
+// resolveJump returns a hop given a stored node name or an inline host
+func resolveJump(j *types.Jump) (*hop, error) {
+	if j.Node != "" {
+		n, err := node.GetNode(app.db, j.Node)
+		if err != nil {
+			return nil, fmt.Errorf("cannot find jump node %s. %v", j.Node, err)
+		}
+		if n.Host == nil {
+			return nil, errors.New("host of jump node " + j.Node + " is nil")
+		}
+		return &hop{name: n.Name, node: n, host: n.Host}, nil
+	}
+	if j.Host == nil {
+		return nil, errors.New("jump host must have a node name or a host")
+	}
+	return &hop{name: j.Host.Addr(), host: j.Host}, nil
+}
+
+// dialHop connects to a hop directly or through the given client.
+// The client is closed when the returned client is closed.
+func dialHop(ctx context.Context, opts *sshOptions, via *ssh.Client, target *hop) (*ssh.Client, error) {
+	h, err := app.vault.Open(target.host)
+	if err != nil {
+		return nil, remote.WithClass(remote.ErrorAuth, err)
+	}
+
+	auth, release, err := authMethods(target.name, h)
+	if err != nil {
+		return nil, remote.WithClass(remote.ErrorAuth, err)
+	}
+	defer release()
+
+	callback, firstUse, err := opts.hostKeys.Callback(h.HostKey)
+	if err != nil {
+		return nil, remote.WithClass(remote.ErrorHostKey, err)
+	}
+	// offer only key types known for the host, so a host with several keys presents the pinned one
+	algorithms, err := opts.hostKeys.Algorithms(h.HostKey, h.Addr())
+	if err != nil {
+		return nil, remote.WithClass(remote.ErrorHostKey, err)
+	}
+	config := &ssh.ClientConfig{
+		User:              h.User,
+		Auth:              auth,
+		HostKeyCallback:   callback,
+		HostKeyAlgorithms: algorithms,
+	}
+
+	client, err := dialClient(ctx, opts, via, h.Addr(), config)
+	if err != nil {
+		return nil, err
+	}
+
+	if key := firstUse(); key != nil {
+		if target.node == nil {
+			log.Printf("WARN: host key of inline jump host %s is not pinned : %s\n", target.name, hostkey.Fingerprint(key))
+		} else if err := pinHostKey(target.node, key); err != nil {
+			log.Printf("failed to pin a host key of node %s. %v\n", target.name, err)
+		}
+	}
+	return client, nil
+}
+
+// authMethods returns auth methods of a host in the order to try.
+// The returned function releases the connection to ssh-agent after the handshake.
+func authMethods(name string, h *types.Host) ([]ssh.AuthMethod, func(), error) {
+	var methods []ssh.AuthMethod
+	var agentConn net.Conn
+	release := func() {
+		if agentConn != nil {
+			_ = agentConn.Close()
+		}
+	}
+
+	for _, method := range h.AuthMethods() {
+		switch method {
+		case types.AuthAgent:
+			sock := os.Getenv("SSH_AUTH_SOCK")
+			if sock == "" {
+				release()
+				return nil, nil, errors.New("cannot use ssh-agent. SSH_AUTH_SOCK is empty")
+			}
+			conn, err := net.Dial("unix", sock)
+			if err != nil {
+				release()
+				return nil, nil, fmt.Errorf("cannot connect ssh-agent. %v", err)
+			}
+			agentConn = conn
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		case types.AuthPublicKey:
+			signer, err := readPrivateKey(name, h)
+			if err != nil {
+				release()
+				return nil, nil, err
+			}
+			methods = append(methods, ssh.PublicKeys(signer))
+		case types.AuthPassword:
+			methods = append(methods, ssh.Password(h.Password))
+		case types.AuthKeyboardInteractive:
+			methods = append(methods, ssh.KeyboardInteractive(keyboardInteractive(name, h.Password)))
+		default:
+			release()
+			return nil, nil, errors.New("unknown auth method " + method)
+		}
+	}
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no auth method for " + name)
+	}
+	return methods, release, nil
+}
+
+var (
+	// promptLock serializes terminal prompts of concurrent connections
+	promptLock sync.Mutex
+	// keyPassphrases caches passphrases entered for key files
+	keyPassphrases = make(map[string]string)
+)
+
+// readPrivateKey parses the key file of a host. An encrypted key is decrypted with
+// the stored passphrase or a passphrase asked on the terminal once per key file.
+func readPrivateKey(name string, h *types.Host) (ssh.Signer, error) {
+	if h.KeyPath == "" {
+		return nil, errors.New("key path of " + name + " is empty")
+	}
+	pemBytes, err := ioutil.ReadFile(h.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	signer, err := ssh.ParsePrivateKey(pemBytes)
+	if _, ok := err.(*ssh.PassphraseMissingError); !ok {
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse a key %s. %v", h.KeyPath, err)
+		}
+		return signer, nil
+	}
+
+	passphrase := h.KeyPassphrase
+	if passphrase == "" {
+		promptLock.Lock()
+		var ok bool
+		if passphrase, ok = keyPassphrases[h.KeyPath]; !ok {
+			passphrase, err = utils.ReadPassphrase(fmt.Sprintf("passphrase for %s (%s): ", h.KeyPath, name))
+			if err == nil {
+				keyPassphrases[h.KeyPath] = passphrase
+			}
+		}
+		promptLock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+	}
+	signer, err = ssh.ParsePrivateKeyWithPassphrase(pemBytes, []byte(passphrase))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt a key %s. %v", h.KeyPath, err)
+	}
+	return signer, nil
+}
+
+// keyboardInteractive answers hidden questions with the password if any, otherwise asks on the terminal
+func keyboardInteractive(name, password string) ssh.KeyboardInteractiveChallenge {
+	return func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+		answers := make([]string, len(questions))
+		for i, q := range questions {
+			if !echos[i] && password != "" {
+				answers[i] = password
+				continue
+			}
+			promptLock.Lock()
+			answer, err := utils.ReadPassphrase(fmt.Sprintf("[%s] %s", name, q))
+			promptLock.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			answers[i] = answer
+		}
+		return answers, nil
+	}
+}
+
+// dialClient opens a ssh connection directly or over a tcp channel of the given client.
+// Dialing and the handshake are each limited by the connect timeout and aborted when the context is done.
+func dialClient(ctx context.Context, opts *sshOptions, via *ssh.Client, addr string, config *ssh.ClientConfig) (*ssh.Client, error) {
+	var conn net.Conn
+	var err error
+	if via == nil {
+		dialer := &net.Dialer{Timeout: opts.connectTimeout}
+		conn, err = dialer.DialContext(ctx, "tcp", addr)
+		if ctx.Err() != nil {
+			err = remote.ContextError(ctx)
+		}
+	} else {
+		stop := watchdog(ctx, opts.connectTimeout, func() { closeClient(via) })
+		conn, err = via.Dial("tcp", addr)
+		if reason := stop(); reason != nil {
+			err = reason
+		}
+	}
+	if err != nil {
+		if conn != nil {
+			_ = conn.Close()
+		}
+		return nil, err
+	}
+
+	stop := watchdog(ctx, opts.connectTimeout, func() { _ = conn.Close() })
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if reason := stop(); reason != nil {
+		if err == nil {
+			_ = c.Close()
+		}
+		err = reason
+	}
+	if err != nil {
+		_ = conn.Close()
+		return nil, err
+	}
+	client := ssh.NewClient(c, chans, reqs)
+	if via != nil {
+		go func() {
+			_ = client.Wait()
+			closeClient(via)
+		}()
+	}
+	return client, nil
+}
+
+// watchdog calls abort once the context is done or the timeout expires, unless stopped before.
+// Zero timeout means no timeout. stop returns the reason why abort was called, or nil.
+func watchdog(ctx context.Context, timeout time.Duration, abort func()) (stop func() error) {
+	done := make(chan struct{})
+	reason := make(chan error, 1)
+	go func() {
+		var expired <-chan time.Time
+		if timeout > 0 {
+			timer := time.NewTimer(timeout)
+			defer timer.Stop()
+			expired = timer.C
+		}
+		select {
+		case <-done:
+			reason <- nil
+			return
+		case <-ctx.Done():
+			reason <- remote.ContextError(ctx)
+		case <-expired:
+			reason <- remote.WithClass(remote.ErrorDial, fmt.Errorf("connection timed out after %v", timeout))
+		}
+		abort()
+	}()
+
+	var once sync.Once
+	var err error
+	return func() error {
+		once.Do(func() {
+			close(done)
+			err = <-reason
+		})
+		return err
+	}
+}
+
+// signalGrace is how long a remote process may take to exit after it was interrupted
+const signalGrace = 3 * time.Second
+
+// waitSession waits for a started session. If the context is done first, the remote process
+// is interrupted and the session is closed unless it exits within the grace period.
+// Output copying may still be running if a closed session does not finish within another grace
+// period, so writers of a session must be safe to read concurrently, e.g. a syncBuffer.
+func waitSession(ctx context.Context, session *ssh.Session) error {
+	wait := make(chan error, 1)
+	go func() {
+		wait <- session.Wait()
+	}()
+	select {
+	case err := <-wait:
+		return err
+	case <-ctx.Done():
+	}
+
+	_ = session.Signal(ssh.SIGINT)
+	select {
+	case <-wait:
+	case <-time.After(signalGrace):
+		_ = session.Close()
+		// Wait returns once stdout and stderr are copied, which ends soon after the close
+		select {
+		case <-wait:
+		case <-time.After(signalGrace):
+		}
+	}
+	return remote.ContextError(ctx)
+}
+
+// syncBuffer is a buffer which is written by a session and read by another goroutine
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+// closeClient closes a client if not nil
+func closeClient(c *ssh.Client) {
+	if c != nil {
+		_ = c.Close()
+	}
+}
+
+// pinHostKey stores the host key on the node record
+func pinHostKey(n *types.Node, key ssh.PublicKey) error {
+	stored, err := node.GetNode(app.db, n.Name)
+	if err != nil {
+		return err
+	}
+	stored.Host.HostKey = hostkey.Marshal(key)
+	if err := node.SaveNode(app.db, stored); err != nil {
+		return err
+	}
+	n.Host.HostKey = stored.Host.HostKey
+	log.Printf("pinned a host key of node %s : %s\n", n.Name, hostkey.Fingerprint(key))
+	return nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/output"
+	"github.com/mesia777/berith-utils/remote"
+	"github.com/mesia777/berith-utils/rpc"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+)
+
+var (
+	statusCommand = cli.Command{
+		Name:      "status",
+		Usage:     "query block number, peers, syncing state, client version and coinbase of nodes over json-rpc",
+		Action:    displayStatus,
+		ArgsUsage: "[node names or empty if all]",
+		Flags:     append([]cli.Flag{utils.RPCFlag, utils.RPCDirectFlag}, berithFlags...),
+	}
+)
+
+// nodeStatus is the status of a node or the reason why it could not be queried
+type nodeStatus struct {
+	Node       string            `json:"node" yaml:"node"`
+	Endpoint   string            `json:"endpoint,omitempty" yaml:"endpoint,omitempty"`
+	Status     *rpc.Status       `json:"status,omitempty" yaml:"status,omitempty"`
+	ErrorClass remote.ErrorClass `json:"errorClass,omitempty" yaml:"errorClass,omitempty"`
+	Error      string            `json:"error,omitempty" yaml:"error,omitempty"`
+}
+
+// newRPCClient returns a json-rpc client of a node. Unless direct, the endpoint is reached
+// through a ssh client of the node which is returned to be closed by the caller.
+func newRPCClient(ctx context.Context, opts *sshOptions, n *types.Node, endpoint string, direct bool) (*rpc.Client, *ssh.Client, error) {
+	if direct {
+		return &rpc.Client{URL: endpoint}, nil, nil
+	}
+	c, err := createSSHClient(ctx, opts, n)
+	if err != nil {
+		return nil, nil, err
+	}
+	return sshRPCClient(c, endpoint), c, nil
+}
+
+// rpcClientOf returns a json-rpc client of a node whose endpoint is rendered from the rpc flag.
+// Unless the rpc.direct flag is set, the endpoint is reached through the connected ssh client.
+func rpcClientOf(ctx *cli.Context, n *types.Node, l *types.Lifecycle, c *ssh.Client) (*rpc.Client, error) {
+	endpoint, err := node.Render(n, l, ctx.String(utils.RPCFlag.Name))
+	if err != nil {
+		return nil, err
+	}
+	if ctx.Bool(utils.RPCDirectFlag.Name) {
+		return &rpc.Client{URL: endpoint}, nil
+	}
+	return sshRPCClient(c, endpoint), nil
+}
+
+// sshRPCClient returns a json-rpc client which connects the endpoint through the ssh client
+func sshRPCClient(c *ssh.Client, endpoint string) *rpc.Client {
+	return &rpc.Client{
+		URL: endpoint,
+		HTTP: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(_ context.Context, network, addr string) (net.Conn, error) {
+					return c.Dial(network, addr)
+				},
+			},
+		},
+	}
+}
+
+// displayStatus query json-rpc endpoints of nodes and display them as a table
+func displayStatus(ctx *cli.Context) error {
+	nodes, err := extractNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("empty nodes to query status")
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	policy, err := newRetryPolicy(ctx)
+	if err != nil {
+		return err
+	}
+	defaults, err := node.GetLifecycleDefaults(app.db)
+	if err != nil {
+		return err
+	}
+	direct := ctx.Bool(utils.RPCDirectFlag.Name)
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	var statusLock sync.Mutex
+	statuses := make(map[string]*rpc.Status, len(nodes))
+
+	query := func(nodeCtx context.Context, n *types.Node) *remote.Result {
+		endpoint, err := node.Render(n, node.ResolveLifecycle(n, defaults), ctx.String(utils.RPCFlag.Name))
+		r := remote.NewResult(n.Name, endpoint)
+		if err != nil {
+			return r.Fail(remote.ErrorConfig, err)
+		}
+
+		client, c, err := newRPCClient(nodeCtx, opts, n, endpoint, direct)
+		if err != nil {
+			return r.Fail(remote.ClassifyConnectError(err), fmt.Errorf("failed to create a ssh client. %v", err))
+		}
+		if c != nil {
+			defer c.Close()
+			stop := watchdog(nodeCtx, 0, func() { _ = c.Close() })
+			defer stop()
+		}
+
+		s, err := client.Status(nodeCtx)
+		if reason := remote.ContextError(nodeCtx); reason != nil {
+			return r.Fail(remote.ClassifyRunError(reason), reason)
+		}
+		if err != nil {
+			return r.Fail(remote.ErrorRPC, err)
+		}
+		statusLock.Lock()
+		statuses[n.Name] = s
+		statusLock.Unlock()
+		return r.Done()
+	}
+
+	results := new(remote.Collector)
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		nodeCtx, cancel := nodeContext(runCtx, ctx)
+		defer cancel()
+		results.Add(policy.Do(nodeCtx, func(attempt int) *remote.Result {
+			return query(nodeCtx, nodes[i])
+		}))
+	})
+
+	var table statusTable
+	for _, r := range results.Results() {
+		table = append(table, &nodeStatus{
+			Node:       r.Node,
+			Endpoint:   r.Command,
+			Status:     statuses[r.Node],
+			ErrorClass: r.ErrorClass,
+			Error:      r.Error,
+		})
+	}
+
+	if printer.Text() {
+		tablePrinter, _ := output.NewPrinter(output.FormatTable, "", os.Stdout)
+		if err := tablePrinter.Print(table); err != nil {
+			return err
+		}
+		success, fail := results.Summary()
+		fmt.Printf("## Complete to query status. success nodes : %v / failures : %v\n", success, fail)
+		printCancelled(results)
+	} else if err := printer.Print(table); err != nil {
+		return err
+	}
+	return checkResults(ctx, results)
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/output"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/mesia777/berith-utils/tunnel"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh"
+	"log"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+)
+
+var (
+	tunnelCommand = cli.Command{
+		Name:      "tunnel",
+		Usage:     "forward local ports to addresses reachable from nodes until interrupted",
+		Action:    openTunnels,
+		ArgsUsage: "[node names or empty if all]",
+		Flags: []cli.Flag{
+			utils.TunnelLocalFlag,
+			utils.TunnelRemoteFlag,
+			utils.TunnelBindFlag,
+			utils.SelectorFlag,
+			utils.ParallelFlag,
+			utils.OutputFlag,
+			utils.TemplateFlag,
+			utils.HostKeyPolicyFlag,
+			utils.KnownHostsFlag,
+			utils.ConnectTimeoutFlag,
+		},
+	}
+)
+
+// nodeTunnel is a ssh client of a node and its listeners
+type nodeTunnel struct {
+	node      *types.Node
+	client    *ssh.Client
+	listeners []net.Listener
+	forwards  []tunnel.Forward
+}
+
+// close closes listeners and the client of a node
+func (t *nodeTunnel) close() {
+	for _, l := range t.listeners {
+		_ = l.Close()
+	}
+	closeClient(t.client)
+}
+
+// openTunnels forwards local ports to remote addresses of nodes given cli context
+func openTunnels(ctx *cli.Context) error {
+	forwards, err := tunnel.ParseForwards(ctx.StringSlice(utils.TunnelLocalFlag.Name), ctx.StringSlice(utils.TunnelRemoteFlag.Name))
+	if err != nil {
+		return err
+	}
+	nodes, err := extractNodes(ctx)
+	if err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		return errors.New("empty nodes to open tunnels")
+	}
+	if len(nodes) > 1 && len(ctx.StringSlice(utils.TunnelLocalFlag.Name)) > 0 {
+		return errors.New("local ports can be given for a single node only")
+	}
+	printer, err := newPrinter(ctx)
+	if err != nil {
+		return err
+	}
+	opts, err := newSSHOptions(ctx)
+	if err != nil {
+		return err
+	}
+	bind := ctx.String(utils.TunnelBindFlag.Name)
+
+	runCtx, cancel := signalContext()
+	defer cancel()
+
+	tunnels := make([]*nodeTunnel, len(nodes))
+	scheduler.Run(ctx.Int(utils.ParallelFlag.Name), len(nodes), func(i int) {
+		n := nodes[i]
+		client, err := createSSHClient(runCtx, opts, n)
+		if err != nil {
+			log.Printf("failed to create a ssh client. node %s, %v\n", n.Name, err)
+			return
+		}
+		t := &nodeTunnel{node: n, client: client, forwards: forwards}
+		for _, f := range forwards {
+			l, err := net.Listen("tcp", net.JoinHostPort(bind, strconv.Itoa(f.Local)))
+			if err != nil {
+				log.Printf("failed to listen for %s of node %s. %v\n", f.Remote, n.Name, err)
+				t.close()
+				return
+			}
+			t.listeners = append(t.listeners, l)
+		}
+		tunnels[i] = t
+	})
+
+	var mappings []*tunnel.Mapping
+	var waitGroup sync.WaitGroup
+	for _, t := range tunnels {
+		if t == nil {
+			continue
+		}
+		t := t
+		logf := func(format string, args ...interface{}) {
+			log.Printf("[%s] %s\n", t.node.Name, fmt.Sprintf(format, args...))
+		}
+		for i, l := range t.listeners {
+			mappings = append(mappings, &tunnel.Mapping{Node: t.node.Name, Local: l.Addr().String(), Remote: t.forwards[i].Remote})
+			go func(l net.Listener, remote string) {
+				_ = tunnel.Serve(l, t.client, remote, logf)
+			}(l, t.forwards[i].Remote)
+		}
+		waitGroup.Add(1)
+		go func() {
+			defer waitGroup.Done()
+			_ = t.client.Wait()
+			if runCtx.Err() == nil {
+				logf("connection closed. stop forwarding")
+			}
+			t.close()
+		}()
+	}
+	if len(mappings) == 0 {
+		return errors.New("failed to open any tunnel")
+	}
+
+	closeAll := func() {
+		for _, t := range tunnels {
+			if t != nil {
+				t.close()
+			}
+		}
+		waitGroup.Wait()
+	}
+	if printer.Text() {
+		printer, _ = output.NewPrinter(output.FormatTable, "", os.Stdout)
+	}
+	if err := printer.Print(mappingTable(mappings)); err != nil {
+		closeAll()
+		return err
+	}
+	log.Println("forwarding. press Ctrl-C to stop")
+
+	// stop when interrupted or when every connection is closed
+	closed := make(chan struct{})
+	go func() {
+		waitGroup.Wait()
+		close(closed)
+	}()
+	select {
+	case <-runCtx.Done():
+		closeAll()
+		return nil
+	case <-closed:
+		return errors.New("connections of all nodes are closed")
+	}
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/db"
+	"github.com/mesia777/berith-utils/node"
+	"github.com/mesia777/berith-utils/types"
+	"github.com/mesia777/berith-utils/utils"
+	"github.com/mesia777/berith-utils/vault"
+	"github.com/urfave/cli"
+	"os"
+)
+
+var (
+	vaultCommand = cli.Command{
+		Action: ShowSubCommand,
+		Name:   "vault",
+		Usage:  "manage the credential vault",
+		Subcommands: []cli.Command{
+			{
+				Name:   "init",
+				Usage:  "Set a master passphrase and encrypt stored secrets",
+				Action: initVault,
+			},
+			{
+				Name:   "lock",
+				Usage:  "Encrypt secrets still stored in plain text",
+				Action: lockVault,
+			},
+			{
+				Name:   "rekey",
+				Usage:  "Change the master passphrase",
+				Action: rekeyVault,
+			},
+		},
+	}
+)
+
+// initVault creates a vault and seals every stored node
+func initVault(ctx *cli.Context) error {
+	if app.vault.Initialized() {
+		return vault.ErrAlreadyExist
+	}
+	passphrase, err := readNewPassphrase(vault.PassphraseEnv, "vault")
+	if err != nil {
+		return err
+	}
+	if err := app.vault.Init(passphrase); err != nil {
+		return err
+	}
+	sealed, err := sealNodes()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("## Vault initialized. sealed nodes : %d\n", sealed)
+	return nil
+}
+
+// lockVault seals secrets of nodes which were saved before the vault was initialized
+func lockVault(ctx *cli.Context) error {
+	if !app.vault.Initialized() {
+		return vault.ErrNotInitialized
+	}
+	sealed, err := sealNodes()
+	if err != nil {
+		return err
+	}
+	app.vault.Lock()
+	fmt.Printf("## Vault locked. sealed nodes : %d\n", sealed)
+	return nil
+}
+
+// rekeyVault re-encrypts every stored secret with a new passphrase
+func rekeyVault(ctx *cli.Context) error {
+	if !app.vault.Initialized() {
+		return vault.ErrNotInitialized
+	}
+	if err := app.vault.Unlock(); err != nil {
+		return err
+	}
+	// GetAllNodes fails on an undecodable record, so no record is left sealed with the old key
+	nodes, err := node.GetAllNodes(app.db)
+	if err != nil {
+		return err
+	}
+	passphrase, err := readNewPassphrase(vault.PassphraseEnv+"_NEW", "vault")
+	if err != nil {
+		return err
+	}
+	if err := autoBackup(app.db, "rekey"); err != nil {
+		return err
+	}
+	// every node is re-sealed before the new key is written, so a secret which does not open
+	// with the current key aborts the rekey instead of becoming unreadable
+	err = app.vault.Rekey(passphrase, func(tx db.Tx, reseal func(h *types.Host) error) error {
+		for _, n := range nodes {
+			if n.Host == nil {
+				continue
+			}
+			if err := reseal(n.Host); err != nil {
+				return fmt.Errorf("failed to rekey node %s. %v", n.Name, err)
+			}
+		}
+		return node.PutNodes(tx, nodes)
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("## Vault rekeyed. nodes : %d\n", len(nodes))
+	return nil
+}
+
+// sealNodes seals plain text secrets of all stored nodes and returns the count of updated nodes
+func sealNodes() (int, error) {
+	nodes, err := node.GetNodes(app.db)
+	if err != nil {
+		return 0, err
+	}
+
+	var sealed []*types.Node
+	for _, n := range nodes {
+		if !vault.HasPlainSecrets(n.Host) {
+			continue
+		}
+		if err := app.vault.Seal(n.Host); err != nil {
+			return 0, err
+		}
+		sealed = append(sealed, n)
+	}
+	if err := node.SaveNodes(app.db, sealed); err != nil {
+		return 0, err
+	}
+	return len(sealed), nil
+}
+
+// readNewPassphrase reads a new passphrase of what from the given env or asks it twice
+func readNewPassphrase(env, what string) (string, error) {
+	if p, ok := os.LookupEnv(env); ok {
+		return p, nil
+	}
+	p, err := utils.ReadPassphrase("new " + what + " passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	confirm, err := utils.ReadPassphrase("repeat passphrase: ")
+	if err != nil {
+		return "", err
+	}
+	if p != confirm {
+		return "", errors.New("passphrases do not match")
+	}
+	return p, nil
+}
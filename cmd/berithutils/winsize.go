@@ -0,0 +1,36 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// watchWindowSize propagates the size of the local terminal to the session whenever it is resized.
+// The returned function stops watching.
+func watchWindowSize(fd int, session *ssh.Session) (stop func()) {
+	signals := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(signals, syscall.SIGWINCH)
+	go func() {
+		for {
+			select {
+			case <-signals:
+				if width, height, err := terminal.GetSize(fd); err == nil {
+					_ = session.WindowChange(height, width)
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+	return func() {
+		signal.Stop(signals)
+		close(done)
+	}
+}
@@ -0,0 +1,10 @@
+package main
+
+import (
+	"golang.org/x/crypto/ssh"
+)
+
+// watchWindowSize does nothing on windows which has no SIGWINCH
+func watchWindowSize(fd int, session *ssh.Session) (stop func()) {
+	return func() {}
+}
@@ -0,0 +1,212 @@
+// Package consensus finds forks among the chains followed by nodes.
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"sort"
+)
+
+// Chain is the canonical chain of a node.
+type Chain interface {
+	BlockHash(ctx context.Context, number uint64) (string, error)
+}
+
+// Fork is a chain followed by one or more nodes.
+type Fork struct {
+	ID      int      `json:"id" yaml:"id"`
+	Tip     uint64   `json:"tip" yaml:"tip"`
+	TipHash string   `json:"tipHash" yaml:"tipHash"`
+	Nodes   []string `json:"nodes" yaml:"nodes"`
+	// Common is the highest block shared with the main fork. It is the tip for the main fork.
+	Common uint64 `json:"common" yaml:"common"`
+}
+
+// NodeState is the head of a node and the fork it follows.
+type NodeState struct {
+	Node string `json:"node" yaml:"node"`
+	Fork int    `json:"fork" yaml:"fork"`
+	Head uint64 `json:"head" yaml:"head"`
+	Hash string `json:"hash" yaml:"hash"`
+	// Behind is the number of blocks between the head and the tip of the fork
+	Behind uint64 `json:"behind" yaml:"behind"`
+}
+
+// Report describes whether nodes agree on the chain.
+// The first fork is the main one which has the highest tip, preferring more nodes on a tie.
+type Report struct {
+	Ancestor     uint64       `json:"ancestor" yaml:"ancestor"`
+	AncestorHash string       `json:"ancestorHash" yaml:"ancestorHash"`
+	Forks        []*Fork      `json:"forks" yaml:"forks"`
+	Nodes        []*NodeState `json:"nodes" yaml:"nodes"`
+}
+
+// checker caches block hashes queried from chains
+type checker struct {
+	ctx    context.Context
+	chains map[string]Chain
+	hashes map[string]map[uint64]string
+}
+
+func (c *checker) hash(node string, number uint64) (string, error) {
+	if h, ok := c.hashes[node][number]; ok {
+		return h, nil
+	}
+	h, err := c.chains[node].BlockHash(c.ctx, number)
+	if err != nil {
+		return "", fmt.Errorf("failed to get block %d of node %s. %v", number, node, err)
+	}
+	if c.hashes[node] == nil {
+		c.hashes[node] = make(map[uint64]string)
+	}
+	c.hashes[node][number] = h
+	return h, nil
+}
+
+// agree returns true if both nodes have the same block at the number
+func (c *checker) agree(a, b string, number uint64) (bool, error) {
+	ha, err := c.hash(a, number)
+	if err != nil {
+		return false, err
+	}
+	hb, err := c.hash(b, number)
+	if err != nil {
+		return false, err
+	}
+	return ha == hb, nil
+}
+
+// lastCommon returns the highest block up to hi shared by both nodes. Blocks are sampled
+// exponentially farther below hi until both agree, then the gap is bisected.
+func (c *checker) lastCommon(a, b string, hi uint64) (uint64, error) {
+	good, bad := hi, hi+1
+	for step := uint64(1); ; step *= 2 {
+		ok, err := c.agree(a, b, good)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			break
+		}
+		if good == 0 {
+			return 0, fmt.Errorf("nodes %s and %s have different genesis blocks", a, b)
+		}
+		bad = good
+		if step > good {
+			good = 0
+		} else {
+			good -= step
+		}
+	}
+	for bad-good > 1 {
+		mid := good + (bad-good)/2
+		ok, err := c.agree(a, b, mid)
+		if err != nil {
+			return 0, err
+		}
+		if ok {
+			good = mid
+		} else {
+			bad = mid
+		}
+	}
+	return good, nil
+}
+
+// Check groups nodes by the chain they follow given their head block numbers,
+// and finds the highest block every node agrees on.
+func Check(ctx context.Context, chains map[string]Chain, heads map[string]uint64) (*Report, error) {
+	if len(heads) == 0 {
+		return nil, fmt.Errorf("no head to check")
+	}
+	c := &checker{ctx: ctx, chains: chains, hashes: make(map[string]map[uint64]string)}
+
+	names := make([]string, 0, len(heads))
+	for name := range heads {
+		names = append(names, name)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if heads[names[i]] != heads[names[j]] {
+			return heads[names[i]] > heads[names[j]]
+		}
+		return names[i] < names[j]
+	})
+
+	// a node follows the fork whose highest node has the same block at the head of the node
+	var forks []*Fork
+	nodes := make([]*NodeState, 0, len(names))
+	for _, name := range names {
+		head := heads[name]
+		hash, err := c.hash(name, head)
+		if err != nil {
+			return nil, err
+		}
+		state := &NodeState{Node: name, Head: head, Hash: hash}
+		nodes = append(nodes, state)
+
+		var fork *Fork
+		for _, f := range forks {
+			tipHash, err := c.hash(f.Nodes[0], head)
+			if err != nil {
+				return nil, err
+			}
+			if tipHash == hash {
+				fork = f
+				break
+			}
+		}
+		if fork == nil {
+			fork = &Fork{Tip: head, TipHash: hash}
+			forks = append(forks, fork)
+		}
+		fork.Nodes = append(fork.Nodes, name)
+		state.Behind = fork.Tip - head
+	}
+
+	sort.SliceStable(forks, func(i, j int) bool {
+		if forks[i].Tip != forks[j].Tip {
+			return forks[i].Tip > forks[j].Tip
+		}
+		return len(forks[i].Nodes) > len(forks[j].Nodes)
+	})
+	forkIDs := make(map[string]int, len(names))
+	for i, f := range forks {
+		f.ID = i
+		for _, name := range f.Nodes {
+			forkIDs[name] = i
+		}
+	}
+	for _, state := range nodes {
+		state.Fork = forkIDs[state.Node]
+	}
+
+	// the common ancestor of all nodes is the lowest of the lowest head
+	// and the blocks each fork shares with the main fork
+	main := forks[0]
+	main.Common = main.Tip
+	ancestor := heads[names[len(names)-1]]
+	for _, f := range forks[1:] {
+		common, err := c.lastCommon(main.Nodes[0], f.Nodes[0], f.Tip)
+		if err != nil {
+			return nil, err
+		}
+		f.Common = common
+		if common < ancestor {
+			ancestor = common
+		}
+	}
+	ancestorHash, err := c.hash(main.Nodes[0], ancestor)
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Node < nodes[j].Node
+	})
+	return &Report{
+		Ancestor:     ancestor,
+		AncestorHash: ancestorHash,
+		Forks:        forks,
+		Nodes:        nodes,
+	}, nil
+}
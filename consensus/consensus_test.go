@@ -0,0 +1,228 @@
+package consensus
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// fakeChain shares blocks with the main chain up to fork and has its own blocks above it, up to head.
+type fakeChain struct {
+	branch string
+	fork   uint64
+	head   uint64
+	calls  int
+	// queried counts queries of each block
+	queried map[uint64]int
+}
+
+func (c *fakeChain) BlockHash(ctx context.Context, number uint64) (string, error) {
+	c.calls++
+	if c.queried == nil {
+		c.queried = make(map[uint64]int)
+	}
+	c.queried[number]++
+	if number > c.head {
+		return "", fmt.Errorf("block %d is not found", number)
+	}
+	if number <= c.fork || c.branch == "" {
+		return fmt.Sprintf("main-%d", number), nil
+	}
+	return fmt.Sprintf("%s-%d", c.branch, number), nil
+}
+
+// mainChain follows the main chain up to head
+func mainChain(head uint64) *fakeChain {
+	return &fakeChain{head: head}
+}
+
+// forkedChain leaves the main chain after the fork block
+func forkedChain(branch string, fork, head uint64) *fakeChain {
+	return &fakeChain{branch: branch, fork: fork, head: head}
+}
+
+func check(t *testing.T, chains map[string]*fakeChain) (*Report, error) {
+	in := make(map[string]Chain, len(chains))
+	heads := make(map[string]uint64, len(chains))
+	for name, c := range chains {
+		in[name] = c
+		heads[name] = c.head
+	}
+	return Check(context.Background(), in, heads)
+}
+
+func TestCheck(t *testing.T) {
+	type fork struct {
+		tip    uint64
+		common uint64
+		nodes  []string
+	}
+	tests := []struct {
+		name     string
+		chains   map[string]*fakeChain
+		ancestor uint64
+		forks    []fork
+		behind   map[string]uint64
+	}{
+		{
+			name:     "identical chains",
+			chains:   map[string]*fakeChain{"n1": mainChain(100), "n2": mainChain(100), "n3": mainChain(100)},
+			ancestor: 100,
+			forks:    []fork{{tip: 100, common: 100, nodes: []string{"n1", "n2", "n3"}}},
+			behind:   map[string]uint64{"n1": 0, "n2": 0, "n3": 0},
+		},
+		{
+			name:     "different heights",
+			chains:   map[string]*fakeChain{"n1": mainChain(100), "n2": mainChain(97), "n3": mainChain(3)},
+			ancestor: 3,
+			forks:    []fork{{tip: 100, common: 100, nodes: []string{"n1", "n2", "n3"}}},
+			behind:   map[string]uint64{"n1": 0, "n2": 3, "n3": 97},
+		},
+		{
+			name:     "fork at the tip",
+			chains:   map[string]*fakeChain{"n1": mainChain(100), "n2": mainChain(100), "n3": forkedChain("b", 99, 100)},
+			ancestor: 99,
+			forks: []fork{
+				{tip: 100, common: 100, nodes: []string{"n1", "n2"}},
+				{tip: 100, common: 99, nodes: []string{"n3"}},
+			},
+			behind: map[string]uint64{"n1": 0, "n2": 0, "n3": 0},
+		},
+		{
+			name:     "fork right after genesis",
+			chains:   map[string]*fakeChain{"n1": mainChain(1000), "n2": forkedChain("b", 0, 800)},
+			ancestor: 0,
+			forks: []fork{
+				{tip: 1000, common: 1000, nodes: []string{"n1"}},
+				{tip: 800, common: 0, nodes: []string{"n2"}},
+			},
+			behind: map[string]uint64{"n1": 0, "n2": 0},
+		},
+		{
+			name: "forks at different heights",
+			chains: map[string]*fakeChain{
+				"n1": mainChain(500),
+				"n2": mainChain(450),
+				"n3": forkedChain("b", 300, 480),
+				"n4": forkedChain("b", 300, 470),
+				"n5": forkedChain("c", 123, 200),
+			},
+			ancestor: 123,
+			forks: []fork{
+				{tip: 500, common: 500, nodes: []string{"n1", "n2"}},
+				{tip: 480, common: 300, nodes: []string{"n3", "n4"}},
+				{tip: 200, common: 123, nodes: []string{"n5"}},
+			},
+			behind: map[string]uint64{"n1": 0, "n2": 50, "n3": 0, "n4": 10, "n5": 0},
+		},
+		{
+			name:     "lagging node below the fork",
+			chains:   map[string]*fakeChain{"n1": mainChain(100), "n2": forkedChain("b", 90, 95), "n3": mainChain(50)},
+			ancestor: 50,
+			forks: []fork{
+				{tip: 100, common: 100, nodes: []string{"n1", "n3"}},
+				{tip: 95, common: 90, nodes: []string{"n2"}},
+			},
+			behind: map[string]uint64{"n1": 0, "n2": 0, "n3": 50},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r, err := check(t, tt.chains)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r.Ancestor != tt.ancestor || r.AncestorHash != fmt.Sprintf("main-%d", tt.ancestor) {
+				t.Errorf("ancestor = %d %s, want %d", r.Ancestor, r.AncestorHash, tt.ancestor)
+			}
+			var forks []fork
+			for i, f := range r.Forks {
+				if f.ID != i {
+					t.Errorf("fork id = %d, want %d", f.ID, i)
+				}
+				forks = append(forks, fork{tip: f.Tip, common: f.Common, nodes: f.Nodes})
+			}
+			if !reflect.DeepEqual(forks, tt.forks) {
+				t.Errorf("forks = %+v, want %+v", forks, tt.forks)
+			}
+			behind := make(map[string]uint64)
+			for _, n := range r.Nodes {
+				behind[n.Node] = n.Behind
+				if !contains(r.Forks[n.Fork].Nodes, n.Node) {
+					t.Errorf("node %s is not in its fork %d", n.Node, n.Fork)
+				}
+			}
+			if !reflect.DeepEqual(behind, tt.behind) {
+				t.Errorf("behind = %v, want %v", behind, tt.behind)
+			}
+		})
+	}
+}
+
+func TestCheckDifferentGenesis(t *testing.T) {
+	chains := map[string]Chain{"n1": mainChain(100), "n2": genesisChain{head: 100}}
+	heads := map[string]uint64{"n1": 100, "n2": 100}
+	if r, err := Check(context.Background(), chains, heads); err == nil {
+		t.Fatalf("expected an error of different genesis blocks, got %+v", r)
+	}
+}
+
+// genesisChain differs from the main chain at every block including genesis
+type genesisChain struct {
+	head uint64
+}
+
+func (c genesisChain) BlockHash(ctx context.Context, number uint64) (string, error) {
+	if number > c.head {
+		return "", fmt.Errorf("block %d is not found", number)
+	}
+	return fmt.Sprintf("other-%d", number), nil
+}
+
+func TestLastCommon(t *testing.T) {
+	const head = 1000
+	for _, fork := range []uint64{0, 1, 2, 3, 100, 511, 512, 513, 997, 998, 999} {
+		a, b := mainChain(head), forkedChain("b", fork, head)
+		c := &checker{
+			ctx:    context.Background(),
+			chains: map[string]Chain{"a": a, "b": b},
+			hashes: make(map[string]map[uint64]string),
+		}
+		got, err := c.lastCommon("a", "b", head)
+		if err != nil {
+			t.Fatalf("fork %d. %v", fork, err)
+		}
+		if got != fork {
+			t.Errorf("lastCommon = %d, want %d", got, fork)
+		}
+		// sampling and bisection query a logarithmic number of blocks
+		if b.calls > 40 {
+			t.Errorf("fork %d queried %d blocks", fork, b.calls)
+		}
+	}
+}
+
+func TestCheckQueriesBlocksOnce(t *testing.T) {
+	chains := map[string]*fakeChain{"n1": mainChain(100), "n2": forkedChain("b", 40, 100), "n3": forkedChain("c", 70, 90)}
+	if _, err := check(t, chains); err != nil {
+		t.Fatal(err)
+	}
+	for name, c := range chains {
+		for number, calls := range c.queried {
+			if calls > 1 {
+				t.Errorf("block %d of %s is queried %d times", number, name, calls)
+			}
+		}
+	}
+}
+
+func contains(values []string, v string) bool {
+	for _, s := range values {
+		if s == v {
+			return true
+		}
+	}
+	return false
+}
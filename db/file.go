@@ -0,0 +1,275 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// FileStore keeps all keys in a single human readable json or yaml file, chosen by the extension,
+// so that an inventory can be reviewed and shared with version control.
+// The whole file is rewritten on every change.
+type FileStore struct {
+	mu   sync.RWMutex
+	path string
+	yaml bool
+	data map[string][]byte
+}
+
+// fileContent is the layout of a store file. Values which are json are kept as documents,
+// others as binary entries.
+type fileContent struct {
+	Entries map[string]interface{} `json:"entries" yaml:"entries"`
+	Binary  map[string][]byte      `json:"binary,omitempty" yaml:"binary,omitempty"`
+}
+
+// NewFileStore opens a store file. A missing file is created on the first change.
+func NewFileStore(path string) (*FileStore, error) {
+	s := &FileStore{
+		path: path,
+		data: make(map[string][]byte),
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+	case ".yaml", ".yml":
+		s.yaml = true
+	default:
+		return nil, errors.New("store file must be .json, .yaml or .yml. got " + path)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := s.decode(b); err != nil {
+		return nil, fmt.Errorf("failed to read a store file %s. %v", path, err)
+	}
+	return s, nil
+}
+
+// decode loads entries of the file
+func (s *FileStore) decode(b []byte) error {
+	var content fileContent
+	if s.yaml {
+		if err := yaml.Unmarshal(b, &content); err != nil {
+			return err
+		}
+	} else {
+		decoder := json.NewDecoder(bytes.NewReader(b))
+		decoder.UseNumber()
+		if err := decoder.Decode(&content); err != nil {
+			return err
+		}
+	}
+	for k, v := range content.Entries {
+		encoded, err := json.Marshal(jsonValue(v))
+		if err != nil {
+			return fmt.Errorf("invalid entry %s. %v", k, err)
+		}
+		s.data[k] = encoded
+	}
+	for k, v := range content.Binary {
+		s.data[k] = v
+	}
+	return nil
+}
+
+// save rewrites the file through a temporary file
+func (s *FileStore) save() error {
+	content := fileContent{Entries: make(map[string]interface{})}
+	for k, v := range s.data {
+		var doc interface{}
+		decoder := json.NewDecoder(bytes.NewReader(v))
+		decoder.UseNumber()
+		if json.Valid(v) && decoder.Decode(&doc) == nil {
+			content.Entries[k] = doc
+			continue
+		}
+		if content.Binary == nil {
+			content.Binary = make(map[string][]byte)
+		}
+		content.Binary[k] = v
+	}
+
+	var b []byte
+	var err error
+	if s.yaml {
+		b, err = yaml.Marshal(yamlValue(content))
+	} else {
+		b, err = json.MarshalIndent(content, "", "  ")
+		b = append(b, '\n')
+	}
+	if err != nil {
+		return err
+	}
+
+	if dir := filepath.Dir(s.path); dir != "" {
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return err
+		}
+	}
+	tmp := s.path + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// Has returns true if the key exists.
+func (s *FileStore) Has(key []byte) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.data[string(key)]
+	return ok, nil
+}
+
+// Get returns a copy of the value of the key.
+func (s *FileStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyBytes(val), nil
+}
+
+// Put inserts the given value and rewrites the file.
+func (s *FileStore) Put(key []byte, value []byte) error {
+	batch := new(Batch)
+	batch.Put(key, value)
+	return s.Write(batch)
+}
+
+// Delete removes the key and rewrites the file.
+func (s *FileStore) Delete(key []byte) error {
+	batch := new(Batch)
+	batch.Delete(key)
+	return s.Write(batch)
+}
+
+// Iterate calls fn with keys having the prefix in key order.
+// Entries are copied first so fn may modify the store.
+func (s *FileStore) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	s.mu.RLock()
+	keys := sortedKeys(s.data, prefix)
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = copyBytes(s.data[k])
+	}
+	s.mu.RUnlock()
+
+	for i, k := range keys {
+		if !fn([]byte(k), values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Write applies all operations of the batch and rewrites the file once.
+// Entries are left unchanged if the file cannot be written.
+func (s *FileStore) Write(batch *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.write(batch)
+}
+
+// Update runs fn in a transaction and rewrites the file once when it is committed.
+// Other writers wait until it is committed or discarded.
+func (s *FileStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := newMapTx(s.data)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return s.write(tx.batch)
+}
+
+// write applies a batch and rewrites the file, restoring entries on failure
+func (s *FileStore) write(batch *Batch) error {
+	backup := make(map[string][]byte, len(s.data))
+	for k, v := range s.data {
+		backup[k] = v
+	}
+	apply(s.data, batch)
+	if err := s.save(); err != nil {
+		s.data = backup
+		return err
+	}
+	return nil
+}
+
+// Close does nothing since every change is already written.
+func (s *FileStore) Close() error {
+	return nil
+}
+
+// Path returns the path to the store file
+func (s *FileStore) Path() string {
+	return s.path
+}
+
+// jsonValue converts maps decoded from yaml to maps which json can encode
+func jsonValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = jsonValue(val)
+		}
+		return m
+	case map[string]interface{}:
+		for k, val := range t {
+			t[k] = jsonValue(val)
+		}
+		return t
+	case []interface{}:
+		for i, val := range t {
+			t[i] = jsonValue(val)
+		}
+		return t
+	}
+	return v
+}
+
+// yamlValue converts json numbers so that yaml writes them as numbers rather than strings
+func yamlValue(v interface{}) interface{} {
+	switch t := v.(type) {
+	case fileContent:
+		for k, val := range t.Entries {
+			t.Entries[k] = yamlValue(val)
+		}
+		return t
+	case map[string]interface{}:
+		for k, val := range t {
+			t[k] = yamlValue(val)
+		}
+		return t
+	case []interface{}:
+		for i, val := range t {
+			t[i] = yamlValue(val)
+		}
+		return t
+	case json.Number:
+		if i, err := t.Int64(); err == nil {
+			return i
+		}
+		if f, err := t.Float64(); err == nil {
+			return f
+		}
+		return t.String()
+	}
+	return v
+}
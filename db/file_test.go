@@ -0,0 +1,137 @@
+package db
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func readAll(t *testing.T, s Store) map[string][]byte {
+	entries := make(map[string][]byte)
+	err := s.Iterate(nil, func(key, value []byte) bool {
+		entries[string(key)] = value
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	entries := map[string][]byte{
+		"config.schema": []byte(`1`),
+		"node.n1":       []byte(`{"host":{"address":"10.0.0.1","port":22},"labels":{"role":"miner"},"name":"n1","revision":3}`),
+		"node.n2":       []byte(`{"name":"n2","tags":["a","b"],"weight":1.5}`),
+		"binary":        {0xff, 0x00, 'x', '\n'},
+		"text":          []byte("not json"),
+	}
+
+	for _, name := range []string{"store.json", "store.yaml", "store.yml"} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "filestore")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			path := filepath.Join(dir, name)
+
+			s, err := NewFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			batch := new(Batch)
+			for k, v := range entries {
+				batch.Put([]byte(k), v)
+			}
+			if err := s.Write(batch); err != nil {
+				t.Fatal(err)
+			}
+
+			reopened, err := NewFileStore(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := readAll(t, reopened)
+			if len(got) != len(entries) {
+				t.Fatalf("entries = %d, want %d", len(got), len(entries))
+			}
+			for k, v := range entries {
+				if !equalValue(got[k], v) {
+					t.Errorf("%s = %q, want %q", k, got[k], v)
+				}
+			}
+			if _, err := reopened.Get([]byte("missing")); err != ErrNotFound {
+				t.Errorf("error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+// equalValue compares json documents by content since the file may reorder object keys
+func equalValue(got, want []byte) bool {
+	if bytes.Equal(got, want) {
+		return true
+	}
+	var g, w interface{}
+	if json.Unmarshal(got, &g) != nil || json.Unmarshal(want, &w) != nil {
+		return false
+	}
+	return reflect.DeepEqual(g, w)
+}
+
+func TestFileStoreFailedSave(t *testing.T) {
+	dir, err := ioutil.TempDir("", "filestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "store.json")
+
+	s, err := NewFileStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Put([]byte("node.n1"), []byte(`{"name":"n1"}`)); err != nil {
+		t.Fatal(err)
+	}
+	saved, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the temporary file cannot be written while a directory is in its place
+	if err := os.Mkdir(path+".tmp", 0700); err != nil {
+		t.Fatal(err)
+	}
+	batch := new(Batch)
+	batch.Delete([]byte("node.n1"))
+	batch.Put([]byte("node.n2"), []byte(`{"name":"n2"}`))
+	if err := s.Write(batch); err == nil {
+		t.Fatal("expected an error of a failed save")
+	}
+	err = s.Update(func(tx Tx) error {
+		return tx.Put([]byte("node.n3"), []byte(`{"name":"n3"}`))
+	})
+	if err == nil {
+		t.Fatal("expected an error of a failed save")
+	}
+
+	got := readAll(t, s)
+	if len(got) != 1 || string(got["node.n1"]) != `{"name":"n1"}` {
+		t.Errorf("entries = %q, want only node.n1", got)
+	}
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, saved) {
+		t.Errorf("file = %s, want %s", b, saved)
+	}
+}
+
+func TestFileStoreExtension(t *testing.T) {
+	if _, err := NewFileStore(filepath.Join(os.TempDir(), "store.txt")); err == nil {
+		t.Error("expected an error of an unknown extension")
+	}
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"fmt"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/errors"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
@@ -9,6 +10,7 @@ import (
 	"log"
 )
 
+// Database is a Store backed by LevelDB.
 type Database struct {
 	db   *leveldb.DB
 	path string
@@ -27,10 +29,10 @@ func NewDatabase(path string, o *opt.Options) (*Database, error) {
 
 	db, err := leveldb.OpenFile(path, &opts)
 	if errors.IsCorrupted(err) {
-		db, err = leveldb.RecoverFile(path, &opts)
-		if err != nil {
-			return nil, err
-		}
+		return nil, fmt.Errorf("database %s is corrupted. %v. check what recovery would lose with `db verify`, then run `db verify --recover`", path, err)
+	}
+	if err != nil {
+		return nil, err
 	}
 	log.Println("Open local database: ", path)
 
@@ -53,6 +55,9 @@ func (db *Database) Put(key []byte, value []byte) error {
 // Get returns a value given key.
 func (db *Database) Get(key []byte) ([]byte, error) {
 	val, err := db.db.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -74,6 +79,53 @@ func (db *Database) NewIteratorWithPrefix(p []byte) iterator.Iterator {
 	return db.db.NewIterator(util.BytesPrefix(p), nil)
 }
 
+// Iterate calls fn with keys having the prefix in key order.
+func (db *Database) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	itr := db.NewIteratorWithPrefix(prefix)
+	defer itr.Release()
+	for itr.Next() {
+		if !fn(copyBytes(itr.Key()), copyBytes(itr.Value())) {
+			break
+		}
+	}
+	return itr.Error()
+}
+
+// Write applies all operations of the batch atomically.
+func (db *Database) Write(batch *Batch) error {
+	b := new(leveldb.Batch)
+	for _, op := range batch.ops {
+		if op.delete {
+			b.Delete(op.key)
+		} else {
+			b.Put(op.key, op.value)
+		}
+	}
+	return db.db.Write(b, nil)
+}
+
+// OpenTransaction opens a transaction. Other writes wait until it is committed or discarded.
+func (db *Database) OpenTransaction() (*Transaction, error) {
+	tr, err := db.db.OpenTransaction()
+	if err != nil {
+		return nil, err
+	}
+	return &Transaction{tr: tr}, nil
+}
+
+// Update runs fn in a transaction which is committed if fn returns nil and discarded otherwise.
+func (db *Database) Update(fn func(tx Tx) error) error {
+	tr, err := db.OpenTransaction()
+	if err != nil {
+		return err
+	}
+	if err := fn(tr); err != nil {
+		tr.Discard()
+		return err
+	}
+	return tr.Commit()
+}
+
 // Delete removes the key from the store.
 func (db *Database) Delete(key []byte) error {
 	return db.db.Delete(key, nil)
@@ -84,6 +136,61 @@ func (db *Database) Path() string {
 	return db.path
 }
 
-func (db *Database) Close() {
-	_ = db.db.Close()
+// Close closes the database.
+func (db *Database) Close() error {
+	return db.db.Close()
+}
+
+// Transaction is a LevelDB transaction.
+type Transaction struct {
+	tr *leveldb.Transaction
+}
+
+// Has returns true if its present in the transaction, otherwise false.
+func (t *Transaction) Has(key []byte) (bool, error) {
+	return t.tr.Has(key, nil)
+}
+
+// Get returns a value given key.
+func (t *Transaction) Get(key []byte) ([]byte, error) {
+	val, err := t.tr.Get(key, nil)
+	if err == leveldb.ErrNotFound {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return val, nil
+}
+
+// Put inserts the given value into the transaction.
+func (t *Transaction) Put(key []byte, value []byte) error {
+	return t.tr.Put(key, value, nil)
+}
+
+// Delete removes the key in the transaction.
+func (t *Transaction) Delete(key []byte) error {
+	return t.tr.Delete(key, nil)
+}
+
+// Iterate calls fn with keys having the prefix in key order, including writes of the transaction.
+func (t *Transaction) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	itr := t.tr.NewIterator(util.BytesPrefix(prefix), nil)
+	defer itr.Release()
+	for itr.Next() {
+		if !fn(copyBytes(itr.Key()), copyBytes(itr.Value())) {
+			break
+		}
+	}
+	return itr.Error()
+}
+
+// Commit writes the transaction into the database.
+func (t *Transaction) Commit() error {
+	return t.tr.Commit()
+}
+
+// Discard drops the transaction.
+func (t *Transaction) Discard() {
+	t.tr.Discard()
 }
@@ -0,0 +1,120 @@
+package db
+
+import (
+	"bytes"
+	"sort"
+	"sync"
+)
+
+// MemoryStore keeps keys in memory. It is useful for tests and dry runs.
+type MemoryStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+// NewMemoryStore returns an empty memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string][]byte)}
+}
+
+// Has returns true if the key exists.
+func (s *MemoryStore) Has(key []byte) (bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.data[string(key)]
+	return ok, nil
+}
+
+// Get returns a copy of the value of the key.
+func (s *MemoryStore) Get(key []byte) ([]byte, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	val, ok := s.data[string(key)]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return copyBytes(val), nil
+}
+
+// Put inserts the given value into the store.
+func (s *MemoryStore) Put(key []byte, value []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data[string(key)] = copyBytes(value)
+	return nil
+}
+
+// Delete removes the key from the store.
+func (s *MemoryStore) Delete(key []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.data, string(key))
+	return nil
+}
+
+// Iterate calls fn with keys having the prefix in key order.
+// Entries are copied first so fn may modify the store.
+func (s *MemoryStore) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	s.mu.RLock()
+	keys := sortedKeys(s.data, prefix)
+	values := make([][]byte, len(keys))
+	for i, k := range keys {
+		values[i] = copyBytes(s.data[k])
+	}
+	s.mu.RUnlock()
+
+	for i, k := range keys {
+		if !fn([]byte(k), values[i]) {
+			break
+		}
+	}
+	return nil
+}
+
+// Write applies all operations of the batch at once.
+func (s *MemoryStore) Write(batch *Batch) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	apply(s.data, batch)
+	return nil
+}
+
+// Update runs fn in a transaction. Other writers wait until it is committed or discarded.
+func (s *MemoryStore) Update(fn func(tx Tx) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tx := newMapTx(s.data)
+	if err := fn(tx); err != nil {
+		return err
+	}
+	apply(s.data, tx.batch)
+	return nil
+}
+
+// Close does nothing.
+func (s *MemoryStore) Close() error {
+	return nil
+}
+
+// apply applies operations of a batch to a map
+func apply(data map[string][]byte, batch *Batch) {
+	for _, op := range batch.ops {
+		if op.delete {
+			delete(data, string(op.key))
+		} else {
+			data[string(op.key)] = op.value
+		}
+	}
+}
+
+// sortedKeys returns sorted keys having the prefix
+func sortedKeys(data map[string][]byte, prefix []byte) []string {
+	var keys []string
+	for k := range data {
+		if bytes.HasPrefix([]byte(k), prefix) {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,136 @@
+// Package db contains key value stores of berithutils: LevelDB, memory and a single json or yaml file.
+package db
+
+import (
+	"errors"
+	"sort"
+)
+
+// ErrNotFound is returned by Get when the key does not exist.
+var ErrNotFound = errors.New("not found")
+
+// Tx reads and writes keys. Writes of a transaction are visible to its own reads.
+type Tx interface {
+	// Has returns true if the key exists.
+	Has(key []byte) (bool, error)
+	// Get returns the value of the key or ErrNotFound.
+	Get(key []byte) ([]byte, error)
+	// Put inserts or overwrites the value of the key.
+	Put(key []byte, value []byte) error
+	// Delete removes the key. Deleting a missing key is not an error.
+	Delete(key []byte) error
+	// Iterate calls fn with keys having the prefix and their values in key order until fn returns false.
+	Iterate(prefix []byte, fn func(key, value []byte) bool) error
+}
+
+// Store is a key value store.
+type Store interface {
+	Tx
+	// Update runs fn in a transaction which is committed if fn returns nil and discarded otherwise.
+	Update(fn func(tx Tx) error) error
+	// Write applies all operations of the batch at once.
+	Write(batch *Batch) error
+	// Close releases the store.
+	Close() error
+}
+
+// Batch collects puts and deletes to be written at once.
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key    []byte
+	value  []byte
+	delete bool
+}
+
+// Put adds a put of the key to the batch.
+func (b *Batch) Put(key, value []byte) {
+	b.ops = append(b.ops, batchOp{key: copyBytes(key), value: copyBytes(value)})
+}
+
+// Delete adds a delete of the key to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.ops = append(b.ops, batchOp{key: copyBytes(key), delete: true})
+}
+
+// Len returns the number of operations in the batch.
+func (b *Batch) Len() int {
+	return len(b.ops)
+}
+
+// mapTx stages writes over a map until they are committed as a batch
+type mapTx struct {
+	data   map[string][]byte
+	staged map[string][]byte
+	batch  *Batch
+}
+
+func newMapTx(data map[string][]byte) *mapTx {
+	return &mapTx{data: data, staged: make(map[string][]byte), batch: new(Batch)}
+}
+
+func (tx *mapTx) Has(key []byte) (bool, error) {
+	if val, ok := tx.staged[string(key)]; ok {
+		return val != nil, nil
+	}
+	_, ok := tx.data[string(key)]
+	return ok, nil
+}
+
+func (tx *mapTx) Get(key []byte) ([]byte, error) {
+	val, ok := tx.staged[string(key)]
+	if !ok {
+		val, ok = tx.data[string(key)]
+	}
+	if !ok || val == nil {
+		return nil, ErrNotFound
+	}
+	return copyBytes(val), nil
+}
+
+func (tx *mapTx) Put(key []byte, value []byte) error {
+	if value == nil {
+		value = []byte{}
+	}
+	tx.staged[string(key)] = copyBytes(value)
+	tx.batch.Put(key, value)
+	return nil
+}
+
+func (tx *mapTx) Delete(key []byte) error {
+	tx.staged[string(key)] = nil
+	tx.batch.Delete(key)
+	return nil
+}
+
+// Iterate calls fn with committed and staged keys having the prefix in key order.
+func (tx *mapTx) Iterate(prefix []byte, fn func(key, value []byte) bool) error {
+	keys := sortedKeys(tx.data, prefix)
+	for _, k := range sortedKeys(tx.staged, prefix) {
+		if _, ok := tx.data[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		val, err := tx.Get([]byte(k))
+		if err == ErrNotFound {
+			continue
+		}
+		if !fn([]byte(k), val) {
+			break
+		}
+	}
+	return nil
+}
+
+func copyBytes(b []byte) []byte {
+	if b == nil {
+		return nil
+	}
+	c := make([]byte, len(b))
+	copy(c, b)
+	return c
+}
@@ -0,0 +1,146 @@
+package db
+
+import (
+	"fmt"
+	"github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// Check is the result of verifying a LevelDB database.
+type Check struct {
+	Path string
+	// Err tells why the database cannot be read as is, nil if it is healthy.
+	Err error
+	// Readable are keys which are read from the database as is.
+	Readable []string
+	// Recovered are records which recovery would keep. nil if the database is healthy.
+	Recovered map[string][]byte
+}
+
+// Healthy returns true if every record is read without recovery.
+func (c *Check) Healthy() bool {
+	return c.Err == nil
+}
+
+// Lost returns readable keys which recovery would drop.
+func (c *Check) Lost() []string {
+	var lost []string
+	for _, key := range c.Readable {
+		if _, ok := c.Recovered[key]; !ok {
+			lost = append(lost, key)
+		}
+	}
+	return lost
+}
+
+// VerifyDatabase reads every record of the database at the path. If it is corrupted,
+// recovery is rehearsed on a copy so the database itself is left untouched.
+func VerifyDatabase(path string) (*Check, error) {
+	if _, err := os.Stat(path); err != nil {
+		return nil, err
+	}
+	tmp, err := ioutil.TempDir("", "berithutilsdb-verify")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(tmp)
+
+	check := &Check{Path: path}
+	readable := filepath.Join(tmp, "readable")
+	if err := copyDir(path, readable); err != nil {
+		return nil, err
+	}
+	check.Readable, check.Err = readKeys(readable)
+	if check.Err == nil {
+		return check, nil
+	}
+
+	recovered := filepath.Join(tmp, "recovered")
+	if err := copyDir(path, recovered); err != nil {
+		return nil, err
+	}
+	ldb, err := leveldb.RecoverFile(recovered, nil)
+	if err != nil {
+		return nil, fmt.Errorf("database is not recoverable. %v", err)
+	}
+	defer ldb.Close()
+	check.Recovered = make(map[string][]byte)
+	itr := ldb.NewIterator(nil, nil)
+	defer itr.Release()
+	for itr.Next() {
+		check.Recovered[string(itr.Key())] = copyBytes(itr.Value())
+	}
+	return check, itr.Error()
+}
+
+// RecoverDatabase copies the database at the path next to it, then rebuilds its manifest from table files.
+// It returns the path of the copy.
+func RecoverDatabase(path string) (string, error) {
+	copied := fmt.Sprintf("%s.corrupted-%s", path, time.Now().Format("20060102-150405"))
+	if err := copyDir(path, copied); err != nil {
+		return "", fmt.Errorf("failed to copy the database. %v", err)
+	}
+	ldb, err := leveldb.RecoverFile(path, nil)
+	if err != nil {
+		return copied, err
+	}
+	return copied, ldb.Close()
+}
+
+// readKeys opens the database read only and returns its keys in order.
+// Keys read before an iterator error are returned with the error.
+func readKeys(path string) ([]string, error) {
+	ldb, err := leveldb.OpenFile(path, &opt.Options{ReadOnly: true, ErrorIfMissing: true, Strict: opt.StrictAll})
+	if err != nil {
+		return nil, err
+	}
+	defer ldb.Close()
+	var keys []string
+	itr := ldb.NewIterator(nil, nil)
+	defer itr.Release()
+	for itr.Next() {
+		keys = append(keys, string(itr.Key()))
+	}
+	return keys, itr.Error()
+}
+
+func copyDir(src, dst string) error {
+	entries, err := ioutil.ReadDir(src)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(dst, 0700); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if !e.Mode().IsRegular() || e.Name() == "LOCK" {
+			continue
+		}
+		if err := copyFile(filepath.Join(src, e.Name()), filepath.Join(dst, e.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyFile(src, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		_ = out.Close()
+		return err
+	}
+	return out.Close()
+}
@@ -0,0 +1,175 @@
+package filesync
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"github.com/pkg/sftp"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// FetchStats counts fetched files.
+type FetchStats struct {
+	Files int   `json:"files"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (s *FetchStats) String() string {
+	return fmt.Sprintf("fetched : %d (%d bytes)", s.Files, s.Bytes)
+}
+
+// Fetch downloads remote files matching the glob pattern into localDir.
+// Matched directories are fetched recursively and modes and times are preserved.
+// Local paths are relative to the directory of the pattern before its first glob element,
+// so matches with the same name in different directories do not overwrite each other.
+func Fetch(client *sftp.Client, pattern, localDir string, logf func(format string, args ...interface{})) (*FetchStats, error) {
+	matches, err := client.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(matches) == 0 {
+		return nil, errors.New("no remote file matches " + pattern)
+	}
+	if err := os.MkdirAll(localDir, 0755); err != nil {
+		return nil, err
+	}
+
+	base := globBase(pattern)
+	stats := &FetchStats{}
+	for _, match := range matches {
+		walker := client.Walk(match)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				return stats, err
+			}
+			rel, err := relPath(base, walker.Path())
+			if err != nil {
+				return stats, err
+			}
+			local := filepath.Join(localDir, filepath.FromSlash(rel))
+			info := walker.Stat()
+
+			if info.IsDir() {
+				if err := os.MkdirAll(local, info.Mode().Perm()|0700); err != nil {
+					return stats, err
+				}
+				continue
+			}
+			if !info.Mode().IsRegular() {
+				continue
+			}
+			if logf != nil {
+				logf("fetch %s (%d bytes)", walker.Path(), info.Size())
+			}
+			n, err := download(client, walker.Path(), local, info)
+			if err != nil {
+				return stats, fmt.Errorf("failed to fetch %s. %v", walker.Path(), err)
+			}
+			stats.Files++
+			stats.Bytes += n
+		}
+	}
+	return stats, nil
+}
+
+// globBase returns the directory of a pattern before its first element having glob meta characters.
+// It is the parent directory of a pattern without them, which is fetched under its own name.
+func globBase(pattern string) string {
+	elems := strings.Split(path.Clean(pattern), "/")
+	for i, e := range elems {
+		if strings.ContainsAny(e, `*?[\`) {
+			if i == 0 {
+				return "."
+			}
+			return path.Clean(strings.Join(elems[:i], "/") + "/")
+		}
+	}
+	return path.Dir(pattern)
+}
+
+// download streams a remote file to a local path preserving mode and modification time
+func download(client *sftp.Client, remotePath, localPath string, info os.FileInfo) (int64, error) {
+	src, err := client.Open(remotePath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	if err := os.MkdirAll(filepath.Dir(localPath), 0755); err != nil {
+		return 0, err
+	}
+	dst, err := os.OpenFile(localPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, info.Mode().Perm())
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	return n, os.Chtimes(localPath, info.ModTime(), info.ModTime())
+}
+
+// Bundle writes the directory tree as a tar.gz archive to dest.
+func Bundle(dir, dest string) error {
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	root := filepath.Base(dir)
+
+	err = filepath.Walk(dir, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(filepath.Join(root, rel))
+		if info.IsDir() {
+			header.Name += "/"
+		}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(tw, src)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if err := gz.Close(); err != nil {
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,432 @@
+// Package filesync mirrors a local directory tree to a remote directory over sftp,
+// skipping files whose remote SHA-256 checksum already matches.
+package filesync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/scheduler"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// ChecksumFunc returns SHA-256 checksums of files under a remote directory
+// keyed by slash separated paths relative to the directory.
+type ChecksumFunc func(dir string) (map[string]string, error)
+
+// Stats counts what a sync did.
+type Stats struct {
+	Uploaded int   `json:"uploaded"`
+	Skipped  int   `json:"skipped"`
+	Deleted  int   `json:"deleted"`
+	Bytes    int64 `json:"bytes"`
+}
+
+func (s *Stats) String() string {
+	return fmt.Sprintf("uploaded : %d (%d bytes), skipped : %d, deleted : %d", s.Uploaded, s.Bytes, s.Skipped, s.Deleted)
+}
+
+// Syncer uploads a local tree to a remote directory.
+type Syncer struct {
+	SFTP *sftp.Client
+	// Checksums computes remote checksums in bulk. Remote files are hashed over sftp if nil or failed.
+	Checksums ChecksumFunc
+	// Delete removes remote files and directories which do not exist locally.
+	Delete bool
+	// Force uploads every file without comparing checksums.
+	Force bool
+	// DryRun reports changes without applying them.
+	DryRun bool
+	// Parallel is the maximum number of files transferred at the same time.
+	Parallel int
+	// Logf receives a line per change.
+	Logf func(format string, args ...interface{})
+}
+
+// entry is a file or directory relative to the synced root
+type entry struct {
+	rel  string
+	info os.FileInfo
+}
+
+// Sync mirrors localDir into remoteDir.
+func (s *Syncer) Sync(localDir, remoteDir string) (*Stats, error) {
+	if s.Delete {
+		home, err := s.isHome(remoteDir)
+		if err != nil {
+			return nil, err
+		}
+		if home {
+			return nil, errors.New("refuse to delete extraneous files in the home directory. use a workspace under it")
+		}
+	}
+	dirs, files, err := walkLocal(localDir)
+	if err != nil {
+		return nil, err
+	}
+	remoteFiles, remoteDirs, err := s.walkRemote(remoteDir)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	for _, d := range dirs {
+		if _, ok := remoteDirs[d.rel]; ok || s.DryRun {
+			continue
+		}
+		if err := s.SFTP.MkdirAll(path.Join(remoteDir, d.rel)); err != nil {
+			return stats, fmt.Errorf("failed to create a directory %s. %v", d.rel, err)
+		}
+		_ = s.SFTP.Chmod(path.Join(remoteDir, d.rel), d.info.Mode().Perm())
+	}
+
+	changed, err := s.changedFiles(localDir, remoteDir, files, remoteFiles)
+	if err != nil {
+		return stats, err
+	}
+	stats.Skipped = len(files) - len(changed)
+
+	var lock sync.Mutex
+	var uploadErr error
+	scheduler.Run(s.Parallel, len(changed), func(i int) {
+		f := changed[i]
+		s.logf("upload %s (%d bytes)", f.rel, f.info.Size())
+		if s.DryRun {
+			lock.Lock()
+			stats.Uploaded++
+			lock.Unlock()
+			return
+		}
+		n, err := s.upload(filepath.Join(localDir, filepath.FromSlash(f.rel)), path.Join(remoteDir, f.rel), f.info)
+		lock.Lock()
+		defer lock.Unlock()
+		if err != nil {
+			s.logf("failed to upload %s. %v", f.rel, err)
+			if uploadErr == nil {
+				uploadErr = fmt.Errorf("failed to upload %s. %v", f.rel, err)
+			}
+			return
+		}
+		stats.Uploaded++
+		stats.Bytes += n
+	})
+	if uploadErr != nil {
+		return stats, uploadErr
+	}
+
+	if s.Delete {
+		if err := s.deleteExtraneous(remoteDir, dirs, files, remoteFiles, remoteDirs, stats); err != nil {
+			return stats, err
+		}
+	}
+	return stats, nil
+}
+
+// changedFiles returns local files which differ from remote ones and syncs modes and times of unchanged ones
+func (s *Syncer) changedFiles(localDir, remoteDir string, files []entry, remoteFiles map[string]os.FileInfo) ([]entry, error) {
+	if s.Force {
+		return files, nil
+	}
+
+	var candidates []entry
+	var changed []entry
+	for _, f := range files {
+		r, ok := remoteFiles[f.rel]
+		if !ok || r.Size() != f.info.Size() {
+			changed = append(changed, f)
+			continue
+		}
+		candidates = append(candidates, f)
+	}
+	if len(candidates) == 0 {
+		return changed, nil
+	}
+
+	var remoteSums map[string]string
+	if s.Checksums != nil {
+		if sums, err := s.Checksums(remoteDir); err == nil {
+			remoteSums = sums
+		} else {
+			s.logf("failed to compute remote checksums in bulk, hash over sftp. %v", err)
+		}
+	}
+
+	for _, f := range candidates {
+		local, err := fileChecksum(filepath.Join(localDir, filepath.FromSlash(f.rel)))
+		if err != nil {
+			return nil, err
+		}
+		remote, ok := remoteSums[f.rel]
+		if !ok {
+			if remote, err = s.remoteChecksum(path.Join(remoteDir, f.rel)); err != nil {
+				changed = append(changed, f)
+				continue
+			}
+		}
+		if local != remote {
+			changed = append(changed, f)
+			continue
+		}
+
+		r := remoteFiles[f.rel]
+		if s.DryRun {
+			continue
+		}
+		p := path.Join(remoteDir, f.rel)
+		if r.Mode().Perm() != f.info.Mode().Perm() {
+			_ = s.SFTP.Chmod(p, f.info.Mode().Perm())
+		}
+		if r.ModTime().Unix() != f.info.ModTime().Unix() {
+			_ = s.SFTP.Chtimes(p, f.info.ModTime(), f.info.ModTime())
+		}
+	}
+	return changed, nil
+}
+
+// upload streams a local file to the remote path preserving mode and modification time
+func (s *Syncer) upload(localPath, remotePath string, info os.FileInfo) (int64, error) {
+	src, err := os.Open(localPath)
+	if err != nil {
+		return 0, err
+	}
+	defer src.Close()
+
+	dst, err := s.SFTP.OpenFile(remotePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return 0, err
+	}
+	n, err := io.Copy(dst, src)
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return n, err
+	}
+	if err := s.SFTP.Chmod(remotePath, info.Mode().Perm()); err != nil {
+		return n, err
+	}
+	return n, s.SFTP.Chtimes(remotePath, info.ModTime(), info.ModTime())
+}
+
+// deleteExtraneous removes remote files and directories which do not exist locally, deepest first
+func (s *Syncer) deleteExtraneous(remoteDir string, dirs, files []entry, remoteFiles, remoteDirs map[string]os.FileInfo, stats *Stats) error {
+	keep := make(map[string]bool, len(dirs)+len(files))
+	for _, e := range dirs {
+		keep[e.rel] = true
+	}
+	for _, e := range files {
+		keep[e.rel] = true
+	}
+
+	var extraneous []string
+	for rel := range remoteFiles {
+		if !keep[rel] {
+			extraneous = append(extraneous, rel)
+		}
+	}
+	var extraneousDirs []string
+	for rel := range remoteDirs {
+		if !keep[rel] {
+			extraneousDirs = append(extraneousDirs, rel)
+		}
+	}
+	sort.Strings(extraneous)
+	sort.Sort(sort.Reverse(sort.StringSlice(extraneousDirs)))
+
+	for _, rel := range append(extraneous, extraneousDirs...) {
+		s.logf("delete %s", rel)
+		stats.Deleted++
+		if s.DryRun {
+			continue
+		}
+		if err := s.SFTP.Remove(path.Join(remoteDir, rel)); err != nil {
+			return fmt.Errorf("failed to delete %s. %v", rel, err)
+		}
+	}
+	return nil
+}
+
+// walkRemote lists remote files and directories. A missing directory is created unless dry run.
+func (s *Syncer) walkRemote(remoteDir string) (map[string]os.FileInfo, map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	dirs := make(map[string]os.FileInfo)
+
+	if _, err := s.SFTP.Stat(remoteDir); os.IsNotExist(err) {
+		if s.DryRun {
+			return files, dirs, nil
+		}
+		return files, dirs, s.SFTP.MkdirAll(remoteDir)
+	} else if err != nil {
+		return nil, nil, err
+	}
+
+	walker := s.SFTP.Walk(remoteDir)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			return nil, nil, err
+		}
+		rel, err := relPath(remoteDir, walker.Path())
+		if err != nil {
+			return nil, nil, err
+		}
+		if rel == "" {
+			continue
+		}
+		if walker.Stat().IsDir() {
+			dirs[rel] = walker.Stat()
+		} else if walker.Stat().Mode().IsRegular() {
+			files[rel] = walker.Stat()
+		}
+	}
+	return files, dirs, nil
+}
+
+// isHome returns true if the remote directory is the home directory of the sftp user
+func (s *Syncer) isHome(remoteDir string) (bool, error) {
+	dir := path.Clean(remoteDir)
+	if dir == "." || dir == "~" {
+		return true, nil
+	}
+	if !path.IsAbs(dir) {
+		return false, nil
+	}
+	home, err := s.SFTP.Getwd()
+	if err != nil {
+		return false, err
+	}
+	return path.Clean(home) == dir, nil
+}
+
+// relPath returns the slash separated path of p relative to dir. It is empty if p is dir itself.
+func relPath(dir, p string) (string, error) {
+	dir, p = path.Clean(dir), path.Clean(p)
+	if p == dir {
+		return "", nil
+	}
+	prefix := dir + "/"
+	switch {
+	case dir == ".":
+		prefix = ""
+		if path.IsAbs(p) || p == ".." || strings.HasPrefix(p, "../") {
+			return "", fmt.Errorf("%s is not under %s", p, dir)
+		}
+	case dir == "/":
+		prefix = "/"
+	}
+	if !strings.HasPrefix(p, prefix) {
+		return "", fmt.Errorf("%s is not under %s", p, dir)
+	}
+	return strings.TrimPrefix(p, prefix), nil
+}
+
+// remoteChecksum hashes a remote file over sftp
+func (s *Syncer) remoteChecksum(p string) (string, error) {
+	f, err := s.SFTP.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func (s *Syncer) logf(format string, args ...interface{}) {
+	if s.Logf != nil {
+		s.Logf(format, args...)
+	}
+}
+
+// walkLocal returns directories and regular files under root. Other files are ignored.
+func walkLocal(root string) ([]entry, []entry, error) {
+	var dirs, files []entry
+	err := filepath.Walk(root, func(p string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		if rel == "." {
+			return nil
+		}
+		rel = filepath.ToSlash(rel)
+		if info.IsDir() {
+			dirs = append(dirs, entry{rel: rel, info: info})
+		} else if info.Mode().IsRegular() {
+			files = append(files, entry{rel: rel, info: info})
+		}
+		return nil
+	})
+	return dirs, files, err
+}
+
+// fileChecksum returns the SHA-256 checksum of a local file
+func fileChecksum(p string) (string, error) {
+	f, err := os.Open(p)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// CommandChecksums computes remote checksums with sha256sum in a single ssh session.
+func CommandChecksums(client *ssh.Client) ChecksumFunc {
+	return func(dir string) (map[string]string, error) {
+		session, err := client.NewSession()
+		if err != nil {
+			return nil, err
+		}
+		defer session.Close()
+
+		var stdout bytes.Buffer
+		session.Stdout = &stdout
+		cmd := fmt.Sprintf("cd %s && find . -type f -exec sha256sum {} +", ShellQuote(dir))
+		if err := session.Run(cmd); err != nil {
+			return nil, err
+		}
+
+		sums := make(map[string]string)
+		scanner := bufio.NewScanner(&stdout)
+		for scanner.Scan() {
+			line := scanner.Text()
+			// escaped names start with a backslash. they are hashed over sftp instead
+			if len(line) < 67 || line[0] == '\\' {
+				continue
+			}
+			sums[strings.TrimPrefix(line[66:], "./")] = line[:64]
+		}
+		return sums, scanner.Err()
+	}
+}
+
+// ShellQuote quotes a path for a posix shell. A leading ~/ is kept unquoted to be expanded.
+func ShellQuote(p string) string {
+	prefix := ""
+	if p == "~" {
+		return p
+	}
+	if strings.HasPrefix(p, "~/") {
+		prefix, p = "~/", p[2:]
+	}
+	return prefix + "'" + strings.Replace(p, "'", `'\''`, -1) + "'"
+}
@@ -0,0 +1,117 @@
+// Package genesis renders genesis files of private berith networks and checks
+// that nodes initialized the same genesis block.
+package genesis
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+)
+
+// DefaultTemplate allocates the balance to every account. Consensus specific fields
+// of berith are expected to come from a user template.
+const DefaultTemplate = `{
+  "config": {
+    "chainId": {{.ChainID}},
+    "homesteadBlock": 0,
+    "eip150Block": 0,
+    "eip155Block": 0,
+    "eip158Block": 0,
+    "byzantiumBlock": 0
+  },
+  "nonce": "0x0",
+  "timestamp": "{{.Timestamp}}",
+  "extraData": "0x",
+  "gasLimit": "0x47b760",
+  "difficulty": "0x1",
+  "coinbase": "0x0000000000000000000000000000000000000000",
+  "alloc": {
+{{- range $i, $a := .Accounts}}{{if $i}},{{end}}
+    "{{$a}}": { "balance": "{{$.Balance}}" }
+{{- end}}
+  }
+}
+`
+
+// Node is the inventory of a node given to a template.
+type Node struct {
+	Name    string
+	Account string
+	Enode   string
+	Labels  map[string]string
+}
+
+// Data is given to a genesis template.
+type Data struct {
+	ChainID   int64
+	Timestamp string
+	Balance   string
+	Accounts  []string
+	Nodes     []*Node
+}
+
+// Render executes the template and returns the indented genesis json.
+func Render(text string, data *Data) ([]byte, error) {
+	t, err := template.New("genesis").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return nil, fmt.Errorf("failed to render a genesis. %v", err)
+	}
+	var indented bytes.Buffer
+	if err := json.Indent(&indented, bytes.TrimSpace(b.Bytes()), "", "  "); err != nil {
+		return nil, fmt.Errorf("rendered genesis is not valid json. %v", err)
+	}
+	indented.WriteByte('\n')
+	return indented.Bytes(), nil
+}
+
+// hashPattern matches the hash logged by init e.g. "Successfully wrote genesis state database=chaindata hash=d4e567…cb8fa3"
+var hashPattern = regexp.MustCompile(`(?i)genesis.*\bhash=(?:0x)?([0-9a-f]+(?:…[0-9a-f]+)?)`)
+
+// ParseInitHash returns the genesis hash in the output of init, or an empty string if not found.
+func ParseInitHash(output string) string {
+	matches := hashPattern.FindAllStringSubmatch(output, -1)
+	if len(matches) == 0 {
+		return ""
+	}
+	return strings.ToLower(matches[len(matches)-1][1])
+}
+
+// ShortHash returns a hash abbreviated like init logs so that full and logged hashes compare equal.
+func ShortHash(hash string) string {
+	hash = strings.TrimPrefix(strings.ToLower(hash), "0x")
+	if strings.Contains(hash, "…") || len(hash) <= 12 {
+		return hash
+	}
+	return hash[:6] + "…" + hash[len(hash)-6:]
+}
+
+// Verify returns an error if nodes reported different genesis hashes. hashes are keyed by node name.
+func Verify(hashes map[string]string) error {
+	if len(hashes) == 0 {
+		return errors.New("no genesis hash to verify")
+	}
+	groups := make(map[string][]string)
+	for name, hash := range hashes {
+		short := ShortHash(hash)
+		groups[short] = append(groups[short], name)
+	}
+	if len(groups) == 1 {
+		return nil
+	}
+	var parts []string
+	for hash, names := range groups {
+		sort.Strings(names)
+		parts = append(parts, fmt.Sprintf("%s : %v", hash, names))
+	}
+	sort.Strings(parts)
+	return fmt.Errorf("nodes have different genesis hashes. %s", strings.Join(parts, ", "))
+}
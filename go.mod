@@ -6,5 +6,6 @@ require (
 	github.com/pkg/sftp v1.10.1
 	github.com/syndtr/goleveldb v1.0.0
 	github.com/urfave/cli v1.22.1
-	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
+	golang.org/x/crypto v0.0.0-20210322153248-0c34fe9e7dc2
+	gopkg.in/yaml.v2 v2.2.2
 )
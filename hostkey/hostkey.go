@@ -0,0 +1,243 @@
+// Package hostkey verifies ssh host keys against pinned keys and known_hosts files.
+package hostkey
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy decides what to do with a host key which is neither pinned nor known.
+type Policy string
+
+const (
+	// PolicyStrict rejects unknown host keys.
+	PolicyStrict Policy = "strict"
+	// PolicyTOFU accepts an unknown host key and pins it after the first successful connection.
+	PolicyTOFU Policy = "tofu"
+	// PolicyInsecure accepts any host key. It must only be used in trusted networks.
+	PolicyInsecure Policy = "insecure"
+)
+
+var errScanned = errors.New("host key scanned")
+
+// ParsePolicy returns a policy given its name.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(strings.ToLower(name)); p {
+	case PolicyStrict, PolicyTOFU, PolicyInsecure:
+		return p, nil
+	}
+	return "", errors.New("unknown host key policy " + name)
+}
+
+// MismatchError is returned when a host presents a key different from the expected one.
+type MismatchError struct {
+	Address string
+	Want    string
+	Got     string
+}
+
+func (e *MismatchError) Error() string {
+	return fmt.Sprintf("host key mismatch for %s. want %s, got %s. possible man-in-the-middle attack", e.Address, e.Want, e.Got)
+}
+
+// Verifier builds host key callbacks.
+type Verifier struct {
+	Policy     Policy
+	KnownHosts []string
+}
+
+// Callback returns a host key callback given the pinned key of a host in authorized_keys format.
+// The returned function reports the key to pin when the host was trusted on first use.
+func (v *Verifier) Callback(pinned string) (ssh.HostKeyCallback, func() ssh.PublicKey, error) {
+	var firstUse ssh.PublicKey
+	unpinned := func() ssh.PublicKey {
+		return firstUse
+	}
+
+	if v.Policy == PolicyInsecure {
+		return ssh.InsecureIgnoreHostKey(), unpinned, nil
+	}
+
+	var want ssh.PublicKey
+	if pinned != "" {
+		key, err := Parse(pinned)
+		if err != nil {
+			return nil, nil, err
+		}
+		want = key
+	}
+
+	known, err := v.knownHosts()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		if want != nil {
+			if !Equal(want, key) {
+				return &MismatchError{Address: hostname, Want: Fingerprint(want), Got: Fingerprint(key)}
+			}
+			return nil
+		}
+
+		if known != nil {
+			err := known(hostname, remote, key)
+			if err == nil {
+				return nil
+			}
+			keyErr, ok := err.(*knownhosts.KeyError)
+			if !ok {
+				return err
+			}
+			// known_hosts may only hold keys of other types for the host, which is not a mismatch
+			for _, k := range keyErr.Want {
+				if k.Key.Type() == key.Type() {
+					return &MismatchError{Address: hostname, Want: Fingerprint(k.Key), Got: Fingerprint(key)}
+				}
+			}
+		}
+
+		if v.Policy != PolicyTOFU {
+			return fmt.Errorf("unknown host key %s for %s. pin it with `node trust`", Fingerprint(key), hostname)
+		}
+		firstUse = key
+		return nil
+	}
+	return callback, unpinned, nil
+}
+
+// Algorithms returns the host key algorithms to negotiate with the host at the address, which are the type
+// of its pinned key or the types of its keys in known_hosts. It is nil if no key is known for the host.
+func (v *Verifier) Algorithms(pinned, address string) ([]string, error) {
+	if v.Policy == PolicyInsecure {
+		return nil, nil
+	}
+	if pinned != "" {
+		key, err := Parse(pinned)
+		if err != nil {
+			return nil, err
+		}
+		return []string{key.Type()}, nil
+	}
+
+	known, err := v.knownHosts()
+	if known == nil || err != nil {
+		return nil, err
+	}
+	// known_hosts reports every known key of a host when the presented key does not match
+	probe, err := probeKey()
+	if err != nil {
+		return nil, err
+	}
+	keyErr, ok := known(address, addrString(address), probe).(*knownhosts.KeyError)
+	if !ok {
+		return nil, nil
+	}
+	var algorithms []string
+	for _, k := range keyErr.Want {
+		algorithms = append(algorithms, k.Key.Type())
+	}
+	sort.Strings(algorithms)
+	return algorithms, nil
+}
+
+// addrString is an address given as host:port
+type addrString string
+
+func (a addrString) Network() string { return "tcp" }
+func (a addrString) String() string  { return string(a) }
+
+// probeKey returns a new key which is never known
+func probeKey() (ssh.PublicKey, error) {
+	pub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return ssh.NewPublicKey(pub)
+}
+
+// knownHosts returns a callback of existing known_hosts files or nil if there is none.
+func (v *Verifier) knownHosts() (ssh.HostKeyCallback, error) {
+	var files []string
+	for _, f := range v.KnownHosts {
+		if f == "" {
+			continue
+		}
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil
+	}
+	return knownhosts.New(files...)
+}
+
+// Scan returns the host key presented by the given address without authenticating.
+func Scan(addr string, timeout time.Duration) (ssh.PublicKey, error) {
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return ScanConn(conn, addr, timeout)
+}
+
+// ScanConn returns the host key presented over the connection, e.g. a channel of a jump host,
+// and closes it. The handshake is aborted after the timeout.
+func ScanConn(conn net.Conn, addr string, timeout time.Duration) (ssh.PublicKey, error) {
+	defer conn.Close()
+	timer := time.AfterFunc(timeout, func() { _ = conn.Close() })
+	defer timer.Stop()
+
+	var scanned ssh.PublicKey
+	config := &ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			scanned = key
+			return errScanned
+		},
+	}
+	c, chans, reqs, err := ssh.NewClientConn(conn, addr, config)
+	if c != nil {
+		_ = ssh.NewClient(c, chans, reqs).Close()
+	}
+	if scanned != nil {
+		return scanned, nil
+	}
+	if err == nil {
+		err = errors.New("no host key presented by " + addr)
+	}
+	return nil, err
+}
+
+// Parse parses a key in authorized_keys format.
+func Parse(s string) (ssh.PublicKey, error) {
+	key, _, _, _, err := ssh.ParseAuthorizedKey([]byte(s))
+	if err != nil {
+		return nil, fmt.Errorf("invalid host key %q. %v", s, err)
+	}
+	return key, nil
+}
+
+// Marshal returns a key in authorized_keys format.
+func Marshal(key ssh.PublicKey) string {
+	return strings.TrimSpace(string(ssh.MarshalAuthorizedKey(key)))
+}
+
+// Fingerprint returns the SHA256 fingerprint of a key.
+func Fingerprint(key ssh.PublicKey) string {
+	return ssh.FingerprintSHA256(key)
+}
+
+// Equal returns true if both keys are the same.
+func Equal(a, b ssh.PublicKey) bool {
+	return string(a.Marshal()) == string(b.Marshal())
+}
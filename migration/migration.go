@@ -0,0 +1,192 @@
+// Package migration upgrades records of a store to the current schema version.
+package migration
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/db"
+	"strconv"
+	"strings"
+)
+
+// versionKey stores the schema version of a store
+var versionKey = []byte("config.schema")
+
+// Migration upgrades records with a prefix to its version.
+type Migration struct {
+	Version     int
+	Description string
+	Prefix      string
+	// Migrate returns the upgraded value of a record and whether it changed
+	Migrate func(key string, value []byte) ([]byte, bool, error)
+}
+
+// Migrations are all migrations in version order. Append new ones with the next version.
+var Migrations = []*Migration{
+	{
+		Version:     1,
+		Description: "default ssh port and revision of node records",
+		Prefix:      "node.",
+		Migrate:     migrateNodeDefaults,
+	},
+}
+
+// CurrentVersion returns the schema version this build writes.
+func CurrentVersion() int {
+	return Migrations[len(Migrations)-1].Version
+}
+
+// Change is an upgrade of a record.
+type Change struct {
+	Version     int    `json:"version" yaml:"version"`
+	Description string `json:"description" yaml:"description"`
+	Key         string `json:"key" yaml:"key"`
+	Old         string `json:"old" yaml:"old"`
+	New         string `json:"new" yaml:"new"`
+}
+
+// Invalid is a record which a migration cannot upgrade.
+type Invalid struct {
+	Version int    `json:"version" yaml:"version"`
+	Key     string `json:"key" yaml:"key"`
+	Error   string `json:"error" yaml:"error"`
+}
+
+// Plan is what a migration of a store would change.
+// Invalid records are left as they are and keep the store at its version until they are fixed or deleted.
+type Plan struct {
+	From    int        `json:"from" yaml:"from"`
+	To      int        `json:"to" yaml:"to"`
+	Changes []*Change  `json:"changes" yaml:"changes"`
+	Invalid []*Invalid `json:"invalid,omitempty" yaml:"invalid,omitempty"`
+
+	values map[string][]byte
+}
+
+// Pending returns true if the store is behind the current version.
+func (p *Plan) Pending() bool {
+	return p.From < p.To
+}
+
+// Version returns the schema version of a store. A store without the version key is version 0.
+func Version(store db.Store) (int, error) {
+	val, err := store.Get(versionKey)
+	if err == db.ErrNotFound {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	v, err := strconv.Atoi(strings.TrimSpace(string(val)))
+	if err != nil {
+		return 0, fmt.Errorf("invalid schema version %q", val)
+	}
+	return v, nil
+}
+
+// NewPlan runs pending migrations in memory and returns the changes without writing them.
+func NewPlan(store db.Store) (*Plan, error) {
+	from, err := Version(store)
+	if err != nil {
+		return nil, err
+	}
+	to := CurrentVersion()
+	if from > to {
+		return nil, fmt.Errorf("schema version %d of the store is newer than %d of this build", from, to)
+	}
+
+	p := &Plan{From: from, To: to, values: make(map[string][]byte)}
+	invalid := make(map[string]bool)
+	for _, m := range Migrations {
+		if m.Version <= from {
+			continue
+		}
+		var keys []string
+		var values [][]byte
+		err := store.Iterate([]byte(m.Prefix), func(key, value []byte) bool {
+			keys = append(keys, string(key))
+			values = append(values, value)
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+		for i, key := range keys {
+			// a record may have been upgraded by a previous migration of the plan
+			value := values[i]
+			if upgraded, ok := p.values[key]; ok {
+				value = upgraded
+			}
+			if invalid[key] {
+				continue
+			}
+			next, changed, err := m.Migrate(key, value)
+			if err != nil {
+				invalid[key] = true
+				p.Invalid = append(p.Invalid, &Invalid{Version: m.Version, Key: key, Error: err.Error()})
+				continue
+			}
+			if !changed {
+				continue
+			}
+			p.values[key] = next
+			p.Changes = append(p.Changes, &Change{
+				Version:     m.Version,
+				Description: m.Description,
+				Key:         key,
+				Old:         string(value),
+				New:         string(next),
+			})
+		}
+	}
+	return p, nil
+}
+
+// Apply writes upgraded records and the new version at once.
+// The version is not written while any record is invalid, so the plan is made again on the next open.
+func (p *Plan) Apply(store db.Store) error {
+	if !p.Pending() {
+		return nil
+	}
+	batch := new(db.Batch)
+	for key, value := range p.values {
+		batch.Put([]byte(key), value)
+	}
+	if len(p.Invalid) == 0 {
+		batch.Put(versionKey, []byte(strconv.Itoa(p.To)))
+	}
+	if batch.Len() == 0 {
+		return nil
+	}
+	return store.Write(batch)
+}
+
+// migrateNodeDefaults sets the ssh port of hosts without one to 22 and the revision of records without one to 1
+func migrateNodeDefaults(key string, value []byte) ([]byte, bool, error) {
+	var record map[string]interface{}
+	if err := json.Unmarshal(value, &record); err != nil {
+		return nil, false, err
+	}
+	changed := false
+	if host, ok := record["host"].(map[string]interface{}); ok {
+		if port, _ := host["port"].(float64); port == 0 {
+			host["port"] = 22
+			changed = true
+		}
+	} else if record["host"] != nil {
+		return nil, false, errors.New("host is not an object")
+	}
+	if revision, _ := record["revision"].(float64); revision == 0 {
+		record["revision"] = 1
+		changed = true
+	}
+	if !changed {
+		return value, false, nil
+	}
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return nil, false, err
+	}
+	return encoded, true, nil
+}
@@ -0,0 +1,102 @@
+package migration
+
+import (
+	"encoding/json"
+	"github.com/mesia777/berith-utils/db"
+	"testing"
+)
+
+func put(t *testing.T, store db.Store, key, value string) {
+	if err := store.Put([]byte(key), []byte(value)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMigrateNodeDefaults(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    string
+		changed bool
+		fail    bool
+	}{
+		{value: `{"name":"n1","host":{"address":"10.0.0.1"}}`, want: `{"host":{"address":"10.0.0.1","port":22},"name":"n1","revision":1}`, changed: true},
+		{value: `{"name":"n1","host":{"port":2222},"revision":3}`, want: `{"name":"n1","host":{"port":2222},"revision":3}`},
+		{value: `{"name":"n1","revision":2}`, want: `{"name":"n1","revision":2}`},
+		{value: `{"name":"n1","host":"10.0.0.1"}`, fail: true},
+		{value: `{`, fail: true},
+	}
+	for _, tt := range tests {
+		got, changed, err := migrateNodeDefaults("node.n1", []byte(tt.value))
+		if (err != nil) != tt.fail {
+			t.Errorf("migrate %s. error = %v, want fail %v", tt.value, err, tt.fail)
+			continue
+		}
+		if tt.fail {
+			continue
+		}
+		if string(got) != tt.want || changed != tt.changed {
+			t.Errorf("migrate %s = %s, %v. want %s, %v", tt.value, got, changed, tt.want, tt.changed)
+		}
+	}
+}
+
+func TestApplySkipsInvalid(t *testing.T) {
+	store := db.NewMemoryStore()
+	put(t, store, "node.n1", `{"name":"n1","host":{"address":"10.0.0.1"}}`)
+	put(t, store, "node.n2", `{"name":"n2","host":"10.0.0.2"}`)
+
+	plan, err := NewPlan(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !plan.Pending() || len(plan.Changes) != 1 || plan.Changes[0].Key != "node.n1" {
+		t.Fatalf("plan = %+v, want a change of node.n1", plan)
+	}
+	if len(plan.Invalid) != 1 || plan.Invalid[0].Key != "node.n2" {
+		t.Fatalf("invalid = %+v, want node.n2", plan.Invalid)
+	}
+	if err := plan.Apply(store); err != nil {
+		t.Fatal(err)
+	}
+
+	// the valid record is upgraded while the invalid one is left as it is
+	val, err := store.Get([]byte("node.n1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var record struct {
+		Host struct {
+			Port int `json:"port"`
+		} `json:"host"`
+	}
+	if err := json.Unmarshal(val, &record); err != nil {
+		t.Fatal(err)
+	}
+	if record.Host.Port != 22 {
+		t.Errorf("port = %d, want 22", record.Host.Port)
+	}
+	if val, _ := store.Get([]byte("node.n2")); string(val) != `{"name":"n2","host":"10.0.0.2"}` {
+		t.Errorf("invalid record = %s, want unchanged", val)
+	}
+	if v, err := Version(store); err != nil || v != 0 {
+		t.Errorf("version = %d, %v. want 0 while a record is invalid", v, err)
+	}
+
+	// the store reaches the current version once the invalid record is removed
+	if err := store.Delete([]byte("node.n2")); err != nil {
+		t.Fatal(err)
+	}
+	plan, err = NewPlan(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 || len(plan.Invalid) != 0 {
+		t.Errorf("plan = %+v, want no changes", plan)
+	}
+	if err := plan.Apply(store); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := Version(store); err != nil || v != CurrentVersion() {
+		t.Errorf("version = %d, %v. want %d", v, err, CurrentVersion())
+	}
+}
@@ -0,0 +1,117 @@
+package node
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/db"
+	"github.com/mesia777/berith-utils/types"
+	"path"
+	"strings"
+	"text/template"
+)
+
+var lifecycleKey = []byte("config.lifecycle")
+
+// ScriptData is given to lifecycle templates
+type ScriptData struct {
+	Name      string
+	Host      *types.Host
+	Labels    map[string]string
+	Workspace string
+}
+
+// GetLifecycleDefaults returns the global lifecycle defaults merged over the built-in one
+func GetLifecycleDefaults(db db.Store) (*types.Lifecycle, error) {
+	has, err := db.Has(lifecycleKey)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return types.DefaultLifecycle(), nil
+	}
+
+	val, err := db.Get(lifecycleKey)
+	if err != nil {
+		return nil, err
+	}
+	var l *types.Lifecycle
+	if err := json.Unmarshal(val, &l); err != nil {
+		return nil, err
+	}
+	return l.Merge(types.DefaultLifecycle()), nil
+}
+
+// SaveLifecycleDefaults saves the global lifecycle defaults
+func SaveLifecycleDefaults(db db.Store, l *types.Lifecycle) error {
+	encoded, err := json.Marshal(l)
+	if err != nil {
+		return err
+	}
+	return db.Put(lifecycleKey, encoded)
+}
+
+// ResolveLifecycle returns the lifecycle of a node merged over the defaults
+func ResolveLifecycle(n *types.Node, defaults *types.Lifecycle) *types.Lifecycle {
+	return n.Lifecycle.Merge(defaults)
+}
+
+// RenderScript renders the command template of a phase for a node
+func RenderScript(n *types.Node, l *types.Lifecycle, phase string) (string, error) {
+	script := l.Script(phase)
+	if script == "" {
+		return "", errors.New("empty " + phase + " script of node " + n.Name)
+	}
+	return Render(n, l, script)
+}
+
+// Render executes a template given node, host without secrets, labels and workspace
+func Render(n *types.Node, l *types.Lifecycle, text string) (string, error) {
+	t, err := template.New(n.Name).Option("missingkey=error").Parse(text)
+	if err != nil {
+		return "", err
+	}
+
+	data := &ScriptData{
+		Name:      n.Name,
+		Host:      &types.Host{},
+		Labels:    n.Labels,
+		Workspace: l.Workspace,
+	}
+	if n.Host != nil {
+		data.Host = n.Host.Copy()
+		for _, s := range data.Host.Secrets() {
+			*s = ""
+		}
+	}
+	if data.Labels == nil {
+		data.Labels = make(map[string]string)
+	}
+
+	var b bytes.Buffer
+	if err := t.Execute(&b, data); err != nil {
+		return "", fmt.Errorf("failed to render a script of node %s. %v", n.Name, err)
+	}
+	return b.String(), nil
+}
+
+// RemotePath returns a workspace path for sftp which resolves paths relative to the home directory
+func RemotePath(workspace string) string {
+	if workspace == "~" {
+		return "."
+	}
+	return strings.TrimPrefix(workspace, "~/")
+}
+
+// ResolveRemotePath returns a path for sftp given a path which is absolute,
+// relative to the home directory with ~/ or relative to the workspace
+func ResolveRemotePath(workspace, p string) string {
+	if path.IsAbs(p) {
+		return p
+	}
+	if p == "~" || strings.HasPrefix(p, "~/") {
+		return RemotePath(p)
+	}
+	return path.Join(RemotePath(workspace), p)
+}
@@ -5,46 +5,89 @@ import (
 	"errors"
 	"fmt"
 	"github.com/mesia777/berith-utils/db"
+	"github.com/mesia777/berith-utils/selector"
 	"github.com/mesia777/berith-utils/types"
 	"log"
 )
 
 // AddNode save node into database
-func AddNode(db *db.Database, node *types.Node) error {
+func AddNode(db db.Store, node *types.Node) error {
+	encoded, err := addNode(db, node)
+	if err != nil {
+		return err
+	}
+	log.Println("success to save a host : ", string(encoded))
+	return nil
+}
+
+// AddNodes save nodes into database at once. Nothing is saved if any node cannot be added.
+func AddNodes(store db.Store, nodes []*types.Node) error {
+	var saved []string
+	err := store.Update(func(tx db.Tx) error {
+		for _, n := range nodes {
+			encoded, err := addNode(tx, n)
+			if err != nil {
+				return fmt.Errorf("failed to add node %s. %v", n.Name, err)
+			}
+			saved = append(saved, string(encoded))
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	for _, encoded := range saved {
+		log.Println("success to save a host : ", encoded)
+	}
+	return nil
+}
+
+// addNode validates and puts a node which does not exist yet
+func addNode(tx db.Tx, node *types.Node) ([]byte, error) {
+	if node.Host == nil {
+		return nil, errors.New("host of node " + node.Name + " is nil")
+	}
 	if !node.HasCredentials() {
 		nodeJson := node.Name
 		b, err := json.Marshal(node)
 		if err == nil {
 			nodeJson = string(b)
 		}
-		return errors.New("must have at least password or key path :" + nodeJson)
+		return nil, errors.New("must have at least password, key path or agent auth :" + nodeJson)
 	}
 
-	has, err := db.Has(getNodeKey(node.Name))
+	has, err := tx.Has(getNodeKey(node.Name))
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if has {
-		return errors.New("already exist node " + node.Name)
+		return nil, errors.New("already exist node " + node.Name)
 	}
 
 	key := getNodeKey(node.Name)
+	node.Revision = 1
 	encoded, err := json.Marshal(node)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	err = db.Put(key, encoded)
-	if err != nil {
-		return err
+	if err := tx.Put(key, encoded); err != nil {
+		return nil, err
 	}
-	log.Println("success to save a host : ", string(encoded))
-	return nil
+	return encoded, nil
 }
 
 // GetNode returns a node from data store given node name
-func GetNode(db *db.Database, name string) (*types.Node, error) {
-	val, err := db.Get(getNodeKey(name))
+func GetNode(db db.Store, name string) (*types.Node, error) {
+	return getNode(db, name)
+}
+
+// getNode reads a node in a transaction or a store
+func getNode(tx db.Tx, name string) (*types.Node, error) {
+	val, err := tx.Get(getNodeKey(name))
+	if err == db.ErrNotFound {
+		return nil, errors.New("not exist node " + name)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -57,61 +100,135 @@ func GetNode(db *db.Database, name string) (*types.Node, error) {
 	return n, nil
 }
 
-// GetNodes returns all node from local store
-func GetNodes(db *db.Database) ([]*types.Node, error) {
-	itr := db.NewIteratorWithPrefix([]byte(types.NodePrefix))
-	var nodes []*types.Node
+// GetNodes returns all node from local store.
+// An undecodable record is skipped with a warning so that the other nodes stay usable.
+func GetNodes(db db.Store) ([]*types.Node, error) {
+	nodes, invalid, err := getNodes(db)
+	if err != nil {
+		return nil, err
+	}
+	for _, decodeErr := range invalid {
+		log.Printf("WARN: skipped %v. check it with `db verify` or remove it with `node delete`\n", decodeErr)
+	}
+	return nodes, nil
+}
 
-	for itr.Next() {
-		var n *types.Node
-		if err := json.Unmarshal(itr.Value(), &n); err != nil {
-			fmt.Println("failed to unmarshal node", err)
-			continue
-		}
-		nodes = append(nodes, n)
+// GetAllNodes returns all node from local store and fails on an undecodable record
+func GetAllNodes(db db.Store) ([]*types.Node, error) {
+	nodes, invalid, err := getNodes(db)
+	if err != nil {
+		return nil, err
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("%v. check it with `db verify` or remove it with `node delete`", invalid[0])
 	}
 	return nodes, nil
 }
 
-// UpdateNode update a given node into data store
-func UpdateNode(db *db.Database, update *types.Node) error {
-	f, err := GetNode(db, update.Name)
+// getNodes decodes all node records and returns an error per undecodable record
+func getNodes(db db.Store) ([]*types.Node, []error, error) {
+	var nodes []*types.Node
+	var invalid []error
+	err := db.Iterate([]byte(types.NodePrefix), func(key, value []byte) bool {
+		var n *types.Node
+		if err := json.Unmarshal(value, &n); err != nil {
+			invalid = append(invalid, fmt.Errorf("undecodable node record %s. %v", key, err))
+			return true
+		}
+		nodes = append(nodes, n)
+		return true
+	})
 	if err != nil {
-		return err
+		return nil, nil, err
 	}
+	return nodes, invalid, nil
+}
 
-	// FIXME : more efficient compare
-	if f.Name != update.Name {
-		f.Name = update.Name
+// SelectNodes returns nodes given names or all nodes if names is empty, filtered by the selector
+func SelectNodes(db db.Store, names []string, sel *selector.Selector) ([]*types.Node, error) {
+	var nodes []*types.Node
+	if len(names) == 0 {
+		all, err := GetNodes(db)
+		if err != nil {
+			return nil, err
+		}
+		nodes = all
+	} else {
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if seen[name] {
+				continue
+			}
+			seen[name] = true
+			n, err := GetNode(db, name)
+			if err != nil {
+				return nil, fmt.Errorf("failed to get node %s. %v", name, err)
+			}
+			nodes = append(nodes, n)
+		}
 	}
-	if f.Host.Address != update.Host.Address {
-		f.Host.Address = update.Host.Address
+
+	var selected []*types.Node
+	for _, n := range nodes {
+		if sel.Matches(n.Labels) {
+			selected = append(selected, n)
+		}
 	}
-	if f.Host.Password != update.Host.Password {
-		f.Host.Password = update.Host.Password
+	return selected, nil
+}
+
+// SaveNode overwrites a stored node with the given one.
+// It fails with a ConflictError if the node was saved by someone else after it was read.
+func SaveNode(db db.Store, node *types.Node) error {
+	return SaveNodes(db, []*types.Node{node})
+}
+
+// SaveNodes overwrites stored nodes with the given ones at once.
+// Revisions of the given nodes are advanced only when all of them are saved.
+func SaveNodes(store db.Store, nodes []*types.Node) error {
+	err := store.Update(func(tx db.Tx) error {
+		return PutNodes(tx, nodes)
+	})
+	if err != nil {
+		return err
 	}
-	if f.Host.Port != update.Host.Port {
-		f.Host.Port = update.Host.Port
+	for _, n := range nodes {
+		n.Revision++
 	}
-	if f.Host.User != update.Host.User {
-		f.Host.User = update.Host.User
+	return nil
+}
+
+// PutNodes overwrites stored nodes with the given ones in a transaction.
+// The given nodes are left unchanged while the stored ones get the next revision.
+func PutNodes(tx db.Tx, nodes []*types.Node) error {
+	for _, n := range nodes {
+		if err := putNode(tx, n); err != nil {
+			return err
+		}
 	}
-	if f.Host.KeyPath != update.Host.KeyPath {
-		f.Host.KeyPath = update.Host.KeyPath
+	return nil
+}
+
+// putNode checks the revision of a stored node and puts the node with the next revision
+func putNode(tx db.Tx, n *types.Node) error {
+	stored, err := getNode(tx, n.Name)
+	if err != nil {
+		return err
 	}
-	if f.Host.Description != update.Host.Description {
-		f.Host.Description = update.Host.Description
+	if stored.Revision != n.Revision {
+		return &ConflictError{Name: n.Name, Revision: stored.Revision, Expected: n.Revision}
 	}
-
-	err = AddNode(db, f)
-	if err == nil {
-		log.Println("success to update")
+	next := *n
+	next.Revision++
+	encoded, err := json.Marshal(&next)
+	if err != nil {
+		return err
 	}
-	return err
+	return tx.Put(getNodeKey(n.Name), encoded)
 }
 
 // DeleteHost delete a node given node name
-func DeleteHost(db *db.Database, name string) error {
+func DeleteHost(db db.Store, name string) error {
 	return db.Delete(getNodeKey(name))
 }
 
@@ -0,0 +1,261 @@
+package node
+
+import (
+	"github.com/mesia777/berith-utils/db"
+	"github.com/mesia777/berith-utils/selector"
+	"github.com/mesia777/berith-utils/types"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+)
+
+func newNode(name string, labels map[string]string) *types.Node {
+	return &types.Node{
+		Name:   name,
+		Host:   &types.Host{User: "berith", Address: name + ".example", Port: 22, Password: "secret"},
+		Labels: labels,
+	}
+}
+
+func nodeNames(nodes []*types.Node) []string {
+	var names []string
+	for _, n := range nodes {
+		names = append(names, n.Name)
+	}
+	return names
+}
+
+func TestAddNode(t *testing.T) {
+	store := db.NewMemoryStore()
+	if err := AddNode(store, newNode("n1", nil)); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := GetNode(store, "n1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n.Host.Address != "n1.example" || n.Revision != 1 {
+		t.Errorf("node = %+v, host = %+v", n, n.Host)
+	}
+	if err := AddNode(store, newNode("n1", nil)); err == nil {
+		t.Error("expected an error adding an existing node")
+	}
+	if _, err := GetNode(store, "n2"); err == nil {
+		t.Error("expected an error getting a missing node")
+	}
+}
+
+func TestAddNodeValidation(t *testing.T) {
+	store := db.NewMemoryStore()
+	if err := AddNode(store, &types.Node{Name: "nohost"}); err == nil {
+		t.Error("expected an error adding a node without a host")
+	}
+	n := newNode("nocred", nil)
+	n.Host.Password = ""
+	if err := AddNode(store, n); err == nil {
+		t.Error("expected an error adding a node without credentials")
+	}
+	if nodes, _ := GetNodes(store); len(nodes) != 0 {
+		t.Errorf("nodes = %v, want none", nodeNames(nodes))
+	}
+}
+
+func TestAddNodesAllOrNothing(t *testing.T) {
+	store := db.NewMemoryStore()
+	if err := AddNode(store, newNode("n2", nil)); err != nil {
+		t.Fatal(err)
+	}
+	err := AddNodes(store, []*types.Node{newNode("n1", nil), newNode("n2", nil), newNode("n3", nil)})
+	if err == nil {
+		t.Fatal("expected an error adding an existing node")
+	}
+	nodes, err := GetNodes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := nodeNames(nodes); !reflect.DeepEqual(names, []string{"n2"}) {
+		t.Errorf("nodes = %v, want [n2]", names)
+	}
+}
+
+func TestGetNodes(t *testing.T) {
+	store := db.NewMemoryStore()
+	for _, name := range []string{"n3", "n1", "n2"} {
+		if err := AddNode(store, newNode(name, nil)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// records of other prefixes are not nodes
+	if err := store.Put([]byte("vault.meta"), []byte("{}")); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes, err := GetNodes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := nodeNames(nodes); !reflect.DeepEqual(names, []string{"n1", "n2", "n3"}) {
+		t.Errorf("nodes = %v, want [n1 n2 n3]", names)
+	}
+
+	if err := store.Put([]byte(types.NodePrefix+"broken"), []byte("{")); err != nil {
+		t.Fatal(err)
+	}
+	// an undecodable record is skipped by GetNodes but fails GetAllNodes
+	nodes, err = GetNodes(store)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := nodeNames(nodes); !reflect.DeepEqual(names, []string{"n1", "n2", "n3"}) {
+		t.Errorf("nodes = %v, want [n1 n2 n3]", names)
+	}
+	if _, err := GetAllNodes(store); err == nil {
+		t.Error("expected an error of an undecodable record")
+	}
+}
+
+func TestSelectNodes(t *testing.T) {
+	store := db.NewMemoryStore()
+	nodes := []*types.Node{
+		newNode("miner1", map[string]string{"role": "miner", "zone": "seoul"}),
+		newNode("miner2", map[string]string{"role": "miner", "zone": "tokyo"}),
+		newNode("boot1", map[string]string{"role": "bootnode", "zone": "seoul"}),
+		newNode("plain", nil),
+	}
+	if err := AddNodes(store, nodes); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		names    []string
+		selector string
+		want     []string
+		fail     bool
+	}{
+		{selector: "", want: []string{"boot1", "miner1", "miner2", "plain"}},
+		{selector: "role=miner", want: []string{"miner1", "miner2"}},
+		{selector: "role in (miner,bootnode),zone!=tokyo", want: []string{"boot1", "miner1"}},
+		{selector: "!role", want: []string{"plain"}},
+		{names: []string{"miner2", "boot1", "miner2"}, want: []string{"miner2", "boot1"}},
+		{names: []string{"miner1", "miner2"}, selector: "zone=tokyo", want: []string{"miner2"}},
+		{names: []string{"missing"}, fail: true},
+	}
+	for _, tt := range tests {
+		sel, err := selector.Parse(tt.selector)
+		if err != nil {
+			t.Fatal(err)
+		}
+		selected, err := SelectNodes(store, tt.names, sel)
+		if tt.fail {
+			if err == nil {
+				t.Errorf("SelectNodes(%v, %q) expected an error", tt.names, tt.selector)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("SelectNodes(%v, %q) failed. %v", tt.names, tt.selector, err)
+			continue
+		}
+		if names := nodeNames(selected); !reflect.DeepEqual(names, tt.want) {
+			t.Errorf("SelectNodes(%v, %q) = %v, want %v", tt.names, tt.selector, names, tt.want)
+		}
+	}
+}
+
+func TestSaveNodeRevision(t *testing.T) {
+	store := db.NewMemoryStore()
+	if err := AddNode(store, newNode("n1", nil)); err != nil {
+		t.Fatal(err)
+	}
+	first, _ := GetNode(store, "n1")
+	second, _ := GetNode(store, "n1")
+
+	first.Host.Port = 2222
+	if err := SaveNode(store, first); err != nil {
+		t.Fatal(err)
+	}
+	second.Host.Port = 3333
+	err := SaveNode(store, second)
+	if _, ok := err.(*ConflictError); !ok {
+		t.Fatalf("error = %v, want a conflict", err)
+	}
+
+	stored, _ := GetNode(store, "n1")
+	if stored.Host.Port != 2222 || stored.Revision != 2 {
+		t.Errorf("stored port %d revision %d, want 2222 and 2", stored.Host.Port, stored.Revision)
+	}
+}
+
+func TestSaveNodesConflictKeepsRevision(t *testing.T) {
+	store := db.NewMemoryStore()
+	if err := AddNodes(store, []*types.Node{newNode("n1", nil), newNode("n2", nil)}); err != nil {
+		t.Fatal(err)
+	}
+	n1, _ := GetNode(store, "n1")
+	n2, _ := GetNode(store, "n2")
+	stale, _ := GetNode(store, "n2")
+	if err := SaveNode(store, stale); err != nil {
+		t.Fatal(err)
+	}
+	if stale.Revision != 2 {
+		t.Errorf("revision after save = %d, want 2", stale.Revision)
+	}
+
+	// n2 conflicts, so n1 is not saved and neither revision moves
+	if err := SaveNodes(store, []*types.Node{n1, n2}); err == nil {
+		t.Fatal("expected a conflict")
+	}
+	if n1.Revision != 1 || n2.Revision != 1 {
+		t.Errorf("revisions = %d, %d, want 1, 1", n1.Revision, n2.Revision)
+	}
+	n2.Revision = 2
+	if err := SaveNodes(store, []*types.Node{n1, n2}); err != nil {
+		t.Fatalf("retry failed. %v", err)
+	}
+}
+
+func TestUpdateNodeRenameJumps(t *testing.T) {
+	dir, err := ioutil.TempDir("", "nodedb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	database, err := db.NewDatabase(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer database.Close()
+
+	for name, store := range map[string]db.Store{"memory": db.NewMemoryStore(), "leveldb": database} {
+		t.Run(name, func(t *testing.T) {
+			bastion := newNode("bastion", nil)
+			inner := newNode("inner", nil)
+			inner.Host.Jump = []*types.Jump{{Node: "bastion"}}
+			deep := newNode("deep", nil)
+			deep.Host.Jump = []*types.Jump{{Node: "inner"}, {Node: "bastion"}}
+			if err := AddNodes(store, []*types.Node{bastion, inner, deep}); err != nil {
+				t.Fatal(err)
+			}
+
+			if _, err := UpdateNode(store, &Patch{Name: "bastion", NewName: "gateway"}); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := GetNode(store, "bastion"); err == nil {
+				t.Error("old name still exists")
+			}
+			if _, err := GetNode(store, "gateway"); err != nil {
+				t.Error(err)
+			}
+			inner, _ = GetNode(store, "inner")
+			deep, _ = GetNode(store, "deep")
+			if inner.Host.Jump[0].Node != "gateway" || inner.Revision != 2 {
+				t.Errorf("inner jumps through %s at revision %d", inner.Host.Jump[0].Node, inner.Revision)
+			}
+			if deep.Host.Jump[0].Node != "inner" || deep.Host.Jump[1].Node != "gateway" {
+				t.Errorf("deep jumps through %s, %s", deep.Host.Jump[0].Node, deep.Host.Jump[1].Node)
+			}
+		})
+	}
+}
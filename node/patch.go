@@ -0,0 +1,173 @@
+package node
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/db"
+	"github.com/mesia777/berith-utils/types"
+	"log"
+)
+
+// ConflictError is returned when a node was saved by someone else after it was read.
+type ConflictError struct {
+	Name     string
+	Revision uint64
+	Expected uint64
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("node %s was modified concurrently. revision is %d, expected %d", e.Name, e.Revision, e.Expected)
+}
+
+// Patch is a partial update of a node. Nil fields are left unchanged.
+type Patch struct {
+	// Name of the node to update
+	Name string
+	// Revision expected to be stored. Zero skips the check
+	Revision uint64
+	// NewName renames the node if not empty
+	NewName string
+
+	User          *string
+	Address       *string
+	Port          *int
+	Password      *string
+	KeyPath       *string
+	KeyPassphrase *string
+	Auth          []string
+	Description   *string
+	Jump          []*types.Jump
+	Labels        map[string]string
+	// Lifecycle is merged over the stored one
+	Lifecycle *types.Lifecycle
+}
+
+// apply changes the node with set fields of the patch
+func (p *Patch) apply(n *types.Node) {
+	if n.Host == nil {
+		n.Host = &types.Host{}
+	}
+	setString(&n.Host.User, p.User)
+	setString(&n.Host.Address, p.Address)
+	if p.Port != nil {
+		n.Host.Port = *p.Port
+	}
+	setString(&n.Host.Password, p.Password)
+	setString(&n.Host.KeyPath, p.KeyPath)
+	setString(&n.Host.KeyPassphrase, p.KeyPassphrase)
+	if p.Auth != nil {
+		n.Host.Auth = p.Auth
+	}
+	setString(&n.Host.Description, p.Description)
+	if p.Jump != nil {
+		n.Host.Jump = p.Jump
+	}
+	if p.Labels != nil {
+		n.Labels = p.Labels
+	}
+	if p.Lifecycle != nil {
+		n.Lifecycle = p.Lifecycle.Merge(n.Lifecycle.Merge(&types.Lifecycle{}))
+	}
+}
+
+func setString(dst *string, v *string) {
+	if v != nil {
+		*dst = *v
+	}
+}
+
+// UpdateNode changes only the set fields of a stored node and renames it if requested.
+// Renaming moves the record to the new key and points jump hosts of other nodes to the new name
+// in the same transaction.
+func UpdateNode(store db.Store, patch *Patch) (*types.Node, error) {
+	var updated *types.Node
+	err := store.Update(func(tx db.Tx) error {
+		n, err := getNode(tx, patch.Name)
+		if err != nil {
+			return err
+		}
+		if patch.Revision != 0 && patch.Revision != n.Revision {
+			return &ConflictError{Name: n.Name, Revision: n.Revision, Expected: patch.Revision}
+		}
+		patch.apply(n)
+		if !n.HasCredentials() {
+			return errors.New("must have at least password, key path or agent auth : " + n.Name)
+		}
+
+		if patch.NewName != "" && patch.NewName != n.Name {
+			has, err := tx.Has(getNodeKey(patch.NewName))
+			if err != nil {
+				return err
+			}
+			if has {
+				return errors.New("already exist node " + patch.NewName)
+			}
+			if err := tx.Delete(getNodeKey(n.Name)); err != nil {
+				return err
+			}
+			if err := renameJumps(tx, n.Name, patch.NewName); err != nil {
+				return err
+			}
+			n.Name = patch.NewName
+		}
+
+		n.Revision++
+		encoded, err := json.Marshal(n)
+		if err != nil {
+			return err
+		}
+		if err := tx.Put(getNodeKey(n.Name), encoded); err != nil {
+			return err
+		}
+		updated = n
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Println("success to update")
+	return updated, nil
+}
+
+// renameJumps points jump hosts referring to a renamed node to its new name
+func renameJumps(tx db.Tx, oldName, newName string) error {
+	var referring []*types.Node
+	var decodeErr error
+	err := tx.Iterate([]byte(types.NodePrefix), func(key, value []byte) bool {
+		var n *types.Node
+		if err := json.Unmarshal(value, &n); err != nil {
+			decodeErr = fmt.Errorf("failed to decode a node record %s. %v", key, err)
+			return false
+		}
+		if n.Host == nil {
+			return true
+		}
+		for _, j := range n.Host.Jump {
+			if j.Node == oldName {
+				referring = append(referring, n)
+				break
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if decodeErr != nil {
+		return decodeErr
+	}
+
+	for _, n := range referring {
+		for _, j := range n.Host.Jump {
+			if j.Node == oldName {
+				j.Node = newName
+			}
+		}
+		if err := putNode(tx, n); err != nil {
+			return err
+		}
+		log.Printf("jump host of node %s is renamed to %s\n", n.Name, newName)
+	}
+	return nil
+}
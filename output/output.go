@@ -0,0 +1,150 @@
+// Package output renders command results as json, yaml, aligned tables or user templates.
+package output
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"io"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"text/template"
+)
+
+const (
+	FormatText     = "text"
+	FormatJSON     = "json"
+	FormatYAML     = "yaml"
+	FormatTable    = "table"
+	FormatTemplate = "template"
+)
+
+// Tabular is implemented by values which can be rendered as a table.
+type Tabular interface {
+	Header() []string
+	Rows() [][]string
+}
+
+// Printer writes values in a selected format.
+type Printer struct {
+	format   string
+	template *template.Template
+	out      io.Writer
+}
+
+// NewPrinter returns a printer given format name and template text.
+// A non empty template implies the template format.
+func NewPrinter(format, tmpl string, out io.Writer) (*Printer, error) {
+	if format == "" {
+		format = FormatText
+	}
+	if tmpl != "" {
+		format = FormatTemplate
+	}
+
+	p := &Printer{
+		format: strings.ToLower(format),
+		out:    out,
+	}
+	switch p.format {
+	case FormatText, FormatJSON, FormatYAML, FormatTable:
+	case FormatTemplate:
+		if tmpl == "" {
+			return nil, errors.New("template format requires a template")
+		}
+		t, err := template.New("output").Parse(tmpl)
+		if err != nil {
+			return nil, err
+		}
+		p.template = t
+	default:
+		return nil, errors.New("unknown output format " + format)
+	}
+	return p, nil
+}
+
+// Text returns true if the caller should keep its human readable console output.
+func (p *Printer) Text() bool {
+	return p.format == FormatText
+}
+
+// Print writes the value. Nothing is written in text format.
+func (p *Printer) Print(v interface{}) error {
+	switch p.format {
+	case FormatJSON:
+		encoder := json.NewEncoder(p.out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(v)
+	case FormatYAML:
+		return p.printYAML(v)
+	case FormatTable:
+		t, ok := v.(Tabular)
+		if !ok {
+			return fmt.Errorf("table format is not supported for %T", v)
+		}
+		return p.printTable(t)
+	case FormatTemplate:
+		return p.printTemplate(v)
+	}
+	return nil
+}
+
+// printYAML converts through json so that json field names and omitempty are kept.
+// The value is wrapped in an object decoded as a MapSlice, which makes every nested object
+// a MapSlice as well and keeps field order whatever the top level value is.
+func (p *Printer) printYAML(v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	var wrapped yaml.MapSlice
+	if err := yaml.Unmarshal(append(append([]byte(`{"v":`), b...), '}'), &wrapped); err != nil {
+		return err
+	}
+	if len(wrapped) != 1 {
+		return fmt.Errorf("failed to convert %T to yaml", v)
+	}
+	encoded, err := yaml.Marshal(wrapped[0].Value)
+	if err != nil {
+		return err
+	}
+	_, err = p.out.Write(encoded)
+	return err
+}
+
+func (p *Printer) printTable(t Tabular) error {
+	w := tabwriter.NewWriter(p.out, 0, 4, 2, ' ', 0)
+	if _, err := fmt.Fprintln(w, strings.Join(t.Header(), "\t")); err != nil {
+		return err
+	}
+	for _, row := range t.Rows() {
+		if _, err := fmt.Fprintln(w, strings.Join(row, "\t")); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// printTemplate executes the template once per element of a slice, or once for other values.
+func (p *Printer) printTemplate(v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Slice {
+		return p.executeTemplate(v)
+	}
+	for i := 0; i < rv.Len(); i++ {
+		if err := p.executeTemplate(rv.Index(i).Interface()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *Printer) executeTemplate(v interface{}) error {
+	if err := p.template.Execute(p.out, v); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintln(p.out)
+	return err
+}
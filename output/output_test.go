@@ -0,0 +1,66 @@
+package output
+
+import (
+	"bytes"
+	"testing"
+)
+
+type item struct {
+	Zone    string   `json:"zone"`
+	Address string   `json:"address,omitempty"`
+	Tags    []string `json:"tags"`
+}
+
+func TestPrintYAML(t *testing.T) {
+	tests := []struct {
+		name string
+		v    interface{}
+		want string
+	}{
+		{
+			name: "scalar",
+			v:    "node1",
+			want: "node1\n",
+		},
+		{
+			name: "slice",
+			v:    []string{"node1", "node2"},
+			want: "- node1\n- node2\n",
+		},
+		{
+			name: "map",
+			v:    map[string]int{"b": 2, "a": 1},
+			want: "a: 1\nb: 2\n",
+		},
+		{
+			name: "field order",
+			v:    item{Zone: "z", Address: "a", Tags: []string{"t"}},
+			want: "zone: z\naddress: a\ntags:\n- t\n",
+		},
+		{
+			name: "omitempty",
+			v:    item{Zone: "z"},
+			want: "zone: z\ntags: null\n",
+		},
+		{
+			name: "slice of structs",
+			v:    []item{{Zone: "z1"}, {Zone: "z2", Address: "a2"}},
+			want: "- zone: z1\n  tags: null\n- zone: z2\n  address: a2\n  tags: null\n",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			p, err := NewPrinter(FormatYAML, "", &buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := p.Print(tt.v); err != nil {
+				t.Fatal(err)
+			}
+			if got := buf.String(); got != tt.want {
+				t.Errorf("yaml =\n%s\nwant\n%s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+// Package peers builds static peer lists of berith nodes from their enode URLs.
+package peers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// Topologies which can be given to Topology
+const (
+	TopologyMesh = "mesh"
+	TopologyRing = "ring"
+	TopologyStar = "star"
+)
+
+// RewriteHost returns the enode URL with its ip replaced by the given address.
+// The listening port and the query such as discport are kept.
+func RewriteHost(enode, addr string) (string, error) {
+	u, err := ParseEnode(enode)
+	if err != nil {
+		return "", err
+	}
+	u.Host = net.JoinHostPort(addr, u.Port())
+	return u.String(), nil
+}
+
+// ParseEnode parses an enode URL e.g. enode://<node id>@10.0.0.1:30303?discport=0
+func ParseEnode(enode string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(enode))
+	if err != nil {
+		return nil, fmt.Errorf("invalid enode %s. %v", enode, err)
+	}
+	if u.Scheme != "enode" || u.User == nil || u.User.Username() == "" {
+		return nil, errors.New("invalid enode " + enode + ". it must be enode://<node id>@<ip>:<port>")
+	}
+	if u.Port() == "" {
+		return nil, errors.New("invalid enode " + enode + ". port is missing")
+	}
+	return u, nil
+}
+
+// Topology returns the peers of every node given node names.
+// The kind is mesh, ring or star:<hub node name>.
+func Topology(kind string, names []string) (map[string][]string, error) {
+	sorted := append([]string(nil), names...)
+	sort.Strings(sorted)
+	peers := make(map[string][]string, len(sorted))
+	for _, name := range sorted {
+		peers[name] = []string{}
+	}
+
+	switch {
+	case kind == TopologyMesh:
+		for _, name := range sorted {
+			for _, peer := range sorted {
+				if peer != name {
+					peers[name] = append(peers[name], peer)
+				}
+			}
+		}
+	case kind == TopologyRing:
+		if len(sorted) < 2 {
+			break
+		}
+		for i, name := range sorted {
+			next := sorted[(i+1)%len(sorted)]
+			prev := sorted[(i+len(sorted)-1)%len(sorted)]
+			peers[name] = append(peers[name], next)
+			if prev != next {
+				peers[name] = append(peers[name], prev)
+			}
+		}
+	case strings.HasPrefix(kind, TopologyStar+":"):
+		hub := strings.TrimPrefix(kind, TopologyStar+":")
+		if _, ok := peers[hub]; !ok {
+			return nil, errors.New("hub node " + hub + " is not among the nodes")
+		}
+		for _, name := range sorted {
+			if name != hub {
+				peers[hub] = append(peers[hub], name)
+				peers[name] = append(peers[name], hub)
+			}
+		}
+	default:
+		return nil, errors.New("unknown topology " + kind + ". mesh, ring or star:<hub node> is available")
+	}
+	return peers, nil
+}
+
+// StaticNodes returns the content of static-nodes.json given enode URLs.
+func StaticNodes(enodes []string) ([]byte, error) {
+	if enodes == nil {
+		enodes = []string{}
+	}
+	b, err := json.MarshalIndent(enodes, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(b, '\n'), nil
+}
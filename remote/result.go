@@ -0,0 +1,213 @@
+// Package remote contains results of operations executed on nodes.
+package remote
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"golang.org/x/crypto/ssh"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrorClass describes the stage in which an operation on a node failed.
+type ErrorClass string
+
+const (
+	ErrorNone       ErrorClass = ""
+	ErrorConfig     ErrorClass = "config"
+	ErrorDial       ErrorClass = "dial"
+	ErrorHostKey    ErrorClass = "hostkey"
+	ErrorAuth       ErrorClass = "auth"
+	ErrorSession    ErrorClass = "session"
+	ErrorRemoteExit ErrorClass = "remote-exit"
+	ErrorTransfer   ErrorClass = "transfer"
+	ErrorRPC        ErrorClass = "rpc"
+	ErrorTimeout    ErrorClass = "timeout"
+	ErrorCancelled  ErrorClass = "cancelled"
+)
+
+// Result is the outcome of an operation on a single node.
+type Result struct {
+	Node       string        `json:"node"`
+	Command    string        `json:"command,omitempty"`
+	ExitStatus int           `json:"exitStatus"`
+	Stdout     string        `json:"stdout,omitempty"`
+	Stderr     string        `json:"stderr,omitempty"`
+	Duration   time.Duration `json:"duration"`
+	Attempts   int           `json:"attempts,omitempty"`
+	ErrorClass ErrorClass    `json:"errorClass,omitempty"`
+	Error      string        `json:"error,omitempty"`
+
+	start time.Time
+}
+
+// NewResult returns a result of the given node and command which is started now.
+func NewResult(node, command string) *Result {
+	return &Result{
+		Node:    node,
+		Command: command,
+		start:   time.Now(),
+	}
+}
+
+// Done stops the duration of the result.
+func (r *Result) Done() *Result {
+	if !r.start.IsZero() {
+		r.Duration = time.Since(r.start)
+		r.start = time.Time{}
+	}
+	return r
+}
+
+// Fail records the error of the given class and stops the duration.
+func (r *Result) Fail(class ErrorClass, err error) *Result {
+	r.ErrorClass = class
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if exit, ok := err.(*ssh.ExitError); ok {
+		r.ExitStatus = exit.ExitStatus()
+	} else if r.ExitStatus == 0 {
+		r.ExitStatus = -1
+	}
+	return r.Done()
+}
+
+// Failed returns true if the operation did not succeed.
+func (r *Result) Failed() bool {
+	return r.ErrorClass != ErrorNone
+}
+
+// ClassError is an error which knows its class.
+type ClassError struct {
+	Class ErrorClass
+	Err   error
+}
+
+func (e *ClassError) Error() string {
+	return e.Err.Error()
+}
+
+// WithClass returns an error carrying the given class. It returns nil for a nil error.
+func WithClass(class ErrorClass, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ClassError{Class: class, Err: err}
+}
+
+// ClassifyConnectError returns the class of an error returned while connecting to a node.
+func ClassifyConnectError(err error) ErrorClass {
+	if err == nil {
+		return ErrorNone
+	}
+	if e, ok := err.(*ClassError); ok {
+		return e.Class
+	}
+	if _, ok := err.(net.Error); ok {
+		return ErrorDial
+	}
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return ErrorAuth
+	}
+	if strings.Contains(err.Error(), "host key") {
+		return ErrorHostKey
+	}
+	return ErrorDial
+}
+
+// ClassifyRunError returns the class of an error returned by a session.
+func ClassifyRunError(err error) ErrorClass {
+	switch e := err.(type) {
+	case nil:
+		return ErrorNone
+	case *ClassError:
+		return e.Class
+	case *ssh.ExitError:
+		return ErrorRemoteExit
+	}
+	return ErrorSession
+}
+
+// ClassifyContext returns the class of a done context, or ErrorNone if it is not done.
+func ClassifyContext(ctx context.Context) ErrorClass {
+	switch ctx.Err() {
+	case nil:
+		return ErrorNone
+	case context.DeadlineExceeded:
+		return ErrorTimeout
+	}
+	return ErrorCancelled
+}
+
+// ContextError returns an error carrying the class of a done context, or nil if it is not done.
+func ContextError(ctx context.Context) error {
+	switch ClassifyContext(ctx) {
+	case ErrorNone:
+		return nil
+	case ErrorTimeout:
+		return WithClass(ErrorTimeout, errors.New("operation timed out"))
+	}
+	return WithClass(ErrorCancelled, errors.New("operation cancelled"))
+}
+
+// Collector aggregates results from many goroutines.
+type Collector struct {
+	mu      sync.Mutex
+	results []*Result
+}
+
+// Add appends a result.
+func (c *Collector) Add(r *Result) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.results = append(c.results, r)
+}
+
+// Results returns all results sorted by node name.
+func (c *Collector) Results() []*Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	results := make([]*Result, len(c.results))
+	copy(results, c.results)
+	sort.SliceStable(results, func(i, j int) bool {
+		return results[i].Node < results[j].Node
+	})
+	return results
+}
+
+// Summary returns node names of succeeded and failed results.
+func (c *Collector) Summary() (success []string, fail []string) {
+	for _, r := range c.Results() {
+		if r.Failed() {
+			fail = append(fail, r.Node)
+		} else {
+			success = append(success, r.Node)
+		}
+	}
+	return success, fail
+}
+
+// Cancelled returns node names of results which were cancelled or timed out.
+func (c *Collector) Cancelled() []string {
+	var cancelled []string
+	for _, r := range c.Results() {
+		if r.ErrorClass == ErrorCancelled || r.ErrorClass == ErrorTimeout {
+			cancelled = append(cancelled, r.Node)
+		}
+	}
+	return cancelled
+}
+
+// Err returns an error describing failed nodes or nil if every node succeeded.
+func (c *Collector) Err() error {
+	_, fail := c.Summary()
+	if len(fail) == 0 {
+		return nil
+	}
+	return fmt.Errorf("failed nodes(#%d) : %v", len(fail), fail)
+}
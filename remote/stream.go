@@ -0,0 +1,91 @@
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// colors are ANSI foreground colors assigned to nodes in turn
+var colors = []string{"\x1b[36m", "\x1b[33m", "\x1b[32m", "\x1b[35m", "\x1b[34m", "\x1b[96m", "\x1b[93m", "\x1b[92m", "\x1b[95m", "\x1b[94m"}
+
+const (
+	colorReset  = "\x1b[0m"
+	colorStderr = "\x1b[31m"
+)
+
+// Streamer writes output lines of many nodes to a shared writer as they arrive,
+// prefixed with the node name.
+type Streamer struct {
+	mu     sync.Mutex
+	out    io.Writer
+	color  bool
+	width  int
+	colors map[string]string
+}
+
+// NewStreamer returns a streamer for the given node names. Prefixes are padded to the longest name.
+func NewStreamer(out io.Writer, color bool, names []string) *Streamer {
+	s := &Streamer{
+		out:    out,
+		color:  color,
+		colors: make(map[string]string, len(names)),
+	}
+	for i, name := range names {
+		if len(name) > s.width {
+			s.width = len(name)
+		}
+		s.colors[name] = colors[i%len(colors)]
+	}
+	return s
+}
+
+// Writer returns a writer prefixing each line of the node. Close flushes a trailing partial line.
+func (s *Streamer) Writer(node string, stderr bool) io.WriteCloser {
+	prefix := fmt.Sprintf("%-*s | ", s.width, node)
+	if s.color {
+		prefix = s.colors[node] + prefix + colorReset
+	}
+	return &lineWriter{streamer: s, prefix: prefix, stderr: stderr}
+}
+
+// writeLine writes a complete line under the lock so that lines of nodes never interleave
+func (s *Streamer) writeLine(prefix string, line []byte, stderr bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if stderr && s.color {
+		_, _ = fmt.Fprintf(s.out, "%s%s%s%s\n", prefix, colorStderr, line, colorReset)
+		return
+	}
+	_, _ = fmt.Fprintf(s.out, "%s%s\n", prefix, line)
+}
+
+// lineWriter buffers partial lines of a node
+type lineWriter struct {
+	streamer *Streamer
+	prefix   string
+	stderr   bool
+	buf      bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.buf.Write(p)
+	for {
+		i := bytes.IndexByte(w.buf.Bytes(), '\n')
+		if i < 0 {
+			break
+		}
+		line := w.buf.Next(i + 1)
+		w.streamer.writeLine(w.prefix, bytes.TrimRight(line, "\r\n"), w.stderr)
+	}
+	return len(p), nil
+}
+
+func (w *lineWriter) Close() error {
+	if w.buf.Len() > 0 {
+		w.streamer.writeLine(w.prefix, w.buf.Bytes(), w.stderr)
+		w.buf.Reset()
+	}
+	return nil
+}
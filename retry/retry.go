@@ -0,0 +1,138 @@
+// Package retry repeats failed operations on nodes with exponential backoff.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/mesia777/berith-utils/remote"
+	"math"
+	"math/rand"
+	"strings"
+	"time"
+)
+
+// DefaultRetryable are the error classes retried by default. They are usually caused by
+// a node which is rebooting, while others need a change of configuration to succeed.
+var DefaultRetryable = []remote.ErrorClass{remote.ErrorDial, remote.ErrorSession, remote.ErrorTransfer}
+
+// DefaultMaxBackoff caps the delay between tries of a policy without MaxBackoff.
+const DefaultMaxBackoff = 10 * time.Minute
+
+// Policy decides whether and when a failed operation is tried again.
+type Policy struct {
+	// Attempts is the maximum number of tries including the first one.
+	Attempts int
+	// Backoff is the delay before the second try. It doubles after every retry.
+	Backoff time.Duration
+	// MaxBackoff caps the delay between tries. Zero means DefaultMaxBackoff.
+	MaxBackoff time.Duration
+	// Jitter randomizes each delay by up to this fraction of it, in [0, 1].
+	Jitter float64
+	// Retryable are the error classes which are tried again.
+	Retryable []remote.ErrorClass
+	// OnRetry is called before waiting for the next try.
+	OnRetry func(r *remote.Result, attempt int, delay time.Duration)
+}
+
+// ParseClasses returns error classes given their names.
+func ParseClasses(names []string) ([]remote.ErrorClass, error) {
+	classes := make([]remote.ErrorClass, 0, len(names))
+	for _, name := range names {
+		switch c := remote.ErrorClass(strings.TrimSpace(name)); c {
+		case remote.ErrorDial, remote.ErrorHostKey, remote.ErrorAuth, remote.ErrorSession,
+			remote.ErrorRemoteExit, remote.ErrorTransfer, remote.ErrorRPC:
+			classes = append(classes, c)
+		default:
+			return nil, errors.New("unknown retryable error class " + name)
+		}
+	}
+	return classes, nil
+}
+
+// Validate returns an error if the policy is invalid.
+func (p *Policy) Validate() error {
+	if p.Attempts < 1 {
+		return fmt.Errorf("attempts must be positive. got %d", p.Attempts)
+	}
+	if p.Backoff < 0 || p.MaxBackoff < 0 {
+		return errors.New("backoff must not be negative")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("jitter must be in [0, 1]. got %v", p.Jitter)
+	}
+	return nil
+}
+
+// retryable returns true if a result of the given class is tried again.
+func (p *Policy) retryable(class remote.ErrorClass) bool {
+	for _, c := range p.Retryable {
+		if c == class {
+			return true
+		}
+	}
+	return false
+}
+
+// Delay returns the delay after the given failed attempt, starting from 1.
+func (p *Policy) Delay(attempt int) time.Duration {
+	max := p.MaxBackoff
+	if max == 0 {
+		max = DefaultMaxBackoff
+	}
+	delay := p.Backoff
+	// doubling stops at the cap, so the delay never overflows however many attempts failed
+	for i := 1; i < attempt && delay < max; i++ {
+		if delay > max/2 {
+			delay = max
+			break
+		}
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	if p.Jitter > 0 && delay > 0 {
+		spread := float64(delay) * p.Jitter * (2*rand.Float64() - 1)
+		if jittered := float64(delay) + spread; jittered < float64(math.MaxInt64) {
+			delay = time.Duration(jittered)
+		}
+	}
+	return delay
+}
+
+// Do calls fn until it succeeds, fails with a class which is not retryable, attempts are
+// exhausted or the context is done. It returns the last result with its attempt count
+// and the duration of all attempts.
+func (p *Policy) Do(ctx context.Context, fn func(attempt int) *remote.Result) *remote.Result {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+
+	start := time.Now()
+	var r *remote.Result
+	defer func() {
+		r.Duration = time.Since(start)
+	}()
+	for attempt := 1; ; attempt++ {
+		r = fn(attempt)
+		r.Attempts = attempt
+		if !r.Failed() || attempt >= attempts || !p.retryable(r.ErrorClass) || ctx.Err() != nil {
+			return r
+		}
+
+		delay := p.Delay(attempt)
+		if p.OnRetry != nil {
+			p.OnRetry(r, attempt, delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			last := fmt.Errorf("%v while waiting to retry. last error(%s) : %s", remote.ContextError(ctx), r.ErrorClass, r.Error)
+			return r.Fail(remote.ClassifyContext(ctx), last)
+		}
+	}
+}
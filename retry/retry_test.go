@@ -0,0 +1,51 @@
+package retry
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  Policy
+		attempt int
+		want    time.Duration
+	}{
+		{"first retry", Policy{Backoff: time.Second, MaxBackoff: time.Minute}, 1, time.Second},
+		{"doubles", Policy{Backoff: time.Second, MaxBackoff: time.Minute}, 4, 8 * time.Second},
+		{"capped", Policy{Backoff: time.Second, MaxBackoff: time.Minute}, 10, time.Minute},
+		{"capped at many attempts", Policy{Backoff: time.Second, MaxBackoff: time.Minute}, 1000, time.Minute},
+		{"backoff over the cap", Policy{Backoff: time.Hour, MaxBackoff: time.Minute}, 1, time.Minute},
+		{"default cap below it", Policy{Backoff: time.Second}, 5, 16 * time.Second},
+		{"default cap", Policy{Backoff: time.Second}, 64, DefaultMaxBackoff},
+		{"default cap at many attempts", Policy{Backoff: time.Second}, math.MaxInt32, DefaultMaxBackoff},
+		{"largest cap", Policy{Backoff: time.Second, MaxBackoff: math.MaxInt64}, 1000, math.MaxInt64},
+		{"no backoff", Policy{}, 100, 0},
+	}
+	for _, tt := range tests {
+		if got := tt.policy.Delay(tt.attempt); got != tt.want {
+			t.Errorf("%s. Delay(%d) = %v, want %v", tt.name, tt.attempt, got, tt.want)
+		}
+	}
+}
+
+func TestDelayJitter(t *testing.T) {
+	tests := []struct {
+		policy   Policy
+		attempt  int
+		min, max time.Duration
+	}{
+		{Policy{Backoff: time.Second, Jitter: 0.5}, 1, 500 * time.Millisecond, 1500 * time.Millisecond},
+		{Policy{Backoff: time.Second, Jitter: 0.5}, 10000, DefaultMaxBackoff / 2, DefaultMaxBackoff * 3 / 2},
+		{Policy{Backoff: time.Second, MaxBackoff: math.MaxInt64, Jitter: 1}, 10000, 0, math.MaxInt64},
+	}
+	for _, tt := range tests {
+		for i := 0; i < 100; i++ {
+			if got := tt.policy.Delay(tt.attempt); got < tt.min || got > tt.max {
+				t.Fatalf("Delay(%d) with jitter %v = %v, want in [%v, %v]", tt.attempt, tt.policy.Jitter, got, tt.min, tt.max)
+			}
+		}
+	}
+}
@@ -0,0 +1,231 @@
+// Package rpc queries the JSON-RPC endpoint of berith nodes.
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Client calls methods of a JSON-RPC endpoint over http.
+type Client struct {
+	// URL is the endpoint e.g. http://127.0.0.1:8545
+	URL string
+	// HTTP sends requests. http.DefaultClient is used if nil.
+	HTTP *http.Client
+
+	id uint64
+}
+
+// Error is an error returned by the endpoint.
+type Error struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("rpc error %d : %s", e.Code, e.Message)
+}
+
+type request struct {
+	Version string        `json:"jsonrpc"`
+	ID      uint64        `json:"id"`
+	Method  string        `json:"method"`
+	Params  []interface{} `json:"params"`
+}
+
+type response struct {
+	ID     uint64          `json:"id"`
+	Result json.RawMessage `json:"result"`
+	Error  *Error          `json:"error"`
+}
+
+// Call calls the method with params and decodes its result into result.
+func (c *Client) Call(ctx context.Context, result interface{}, method string, params ...interface{}) error {
+	if params == nil {
+		params = []interface{}{}
+	}
+	body, err := json.Marshal(&request{
+		Version: "2.0",
+		ID:      atomic.AddUint64(&c.id, 1),
+		Method:  method,
+		Params:  params,
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, c.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	httpClient := c.HTTP
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	resp, err := httpClient.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to call %s. %s", method, resp.Status)
+	}
+
+	var r response
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("failed to decode a response of %s. %v", method, err)
+	}
+	if r.Error != nil {
+		return r.Error
+	}
+	if result == nil {
+		return nil
+	}
+	if err := json.Unmarshal(r.Result, result); err != nil {
+		return fmt.Errorf("failed to decode a result of %s. %v", method, err)
+	}
+	return nil
+}
+
+// Status is the state of a node reported by its endpoint.
+type Status struct {
+	ClientVersion string `json:"clientVersion" yaml:"clientVersion"`
+	BlockNumber   uint64 `json:"blockNumber" yaml:"blockNumber"`
+	Peers         uint64 `json:"peers" yaml:"peers"`
+	Syncing       bool   `json:"syncing" yaml:"syncing"`
+	CurrentBlock  uint64 `json:"currentBlock,omitempty" yaml:"currentBlock,omitempty"`
+	HighestBlock  uint64 `json:"highestBlock,omitempty" yaml:"highestBlock,omitempty"`
+	Coinbase      string `json:"coinbase,omitempty" yaml:"coinbase,omitempty"`
+}
+
+// Status queries client version, block number, peer count, syncing state and coinbase.
+// A node without a coinbase is not an error.
+func (c *Client) Status(ctx context.Context) (*Status, error) {
+	s := &Status{}
+	if err := c.Call(ctx, &s.ClientVersion, "web3_clientVersion"); err != nil {
+		return nil, err
+	}
+
+	var err error
+	if s.BlockNumber, err = c.BlockNumber(ctx); err != nil {
+		return nil, err
+	}
+	var peers string
+	if err := c.Call(ctx, &peers, "net_peerCount"); err != nil {
+		return nil, err
+	}
+	if s.Peers, err = parseQuantity(peers); err != nil {
+		return nil, err
+	}
+
+	// eth_syncing returns false or a progress object
+	var syncing json.RawMessage
+	if err := c.Call(ctx, &syncing, "eth_syncing"); err != nil {
+		return nil, err
+	}
+	if string(syncing) != "false" {
+		var progress struct {
+			CurrentBlock string `json:"currentBlock"`
+			HighestBlock string `json:"highestBlock"`
+		}
+		if err := json.Unmarshal(syncing, &progress); err != nil {
+			return nil, fmt.Errorf("failed to decode syncing state. %v", err)
+		}
+		s.Syncing = true
+		if s.CurrentBlock, err = parseQuantity(progress.CurrentBlock); err != nil {
+			return nil, err
+		}
+		if s.HighestBlock, err = parseQuantity(progress.HighestBlock); err != nil {
+			return nil, err
+		}
+	}
+
+	if s.Coinbase, err = c.Coinbase(ctx); err != nil {
+		if _, ok := err.(*Error); !ok {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Coinbase returns the account which receives rewards of the node.
+func (c *Client) Coinbase(ctx context.Context) (string, error) {
+	var coinbase string
+	if err := c.Call(ctx, &coinbase, "eth_coinbase"); err != nil {
+		return "", err
+	}
+	return coinbase, nil
+}
+
+// BlockNumber returns the number of the head block.
+func (c *Client) BlockNumber(ctx context.Context) (uint64, error) {
+	var block string
+	if err := c.Call(ctx, &block, "eth_blockNumber"); err != nil {
+		return 0, err
+	}
+	return parseQuantity(block)
+}
+
+// BlockHash returns the hash of the canonical block at the given number.
+func (c *Client) BlockHash(ctx context.Context, number uint64) (string, error) {
+	var header *struct {
+		Hash string `json:"hash"`
+	}
+	if err := c.Call(ctx, &header, "eth_getBlockByNumber", fmt.Sprintf("0x%x", number), false); err != nil {
+		return "", err
+	}
+	if header == nil || header.Hash == "" {
+		return "", fmt.Errorf("block %d is not found", number)
+	}
+	return header.Hash, nil
+}
+
+// NodeInfo is the result of admin_nodeInfo.
+type NodeInfo struct {
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	Enode      string `json:"enode"`
+	IP         string `json:"ip"`
+	ListenAddr string `json:"listenAddr"`
+}
+
+// NodeInfo returns information of the node including its enode URL.
+func (c *Client) NodeInfo(ctx context.Context) (*NodeInfo, error) {
+	var info NodeInfo
+	if err := c.Call(ctx, &info, "admin_nodeInfo"); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// AddPeer asks the node to connect to the enode and keep the connection.
+func (c *Client) AddPeer(ctx context.Context, enode string) error {
+	var ok bool
+	if err := c.Call(ctx, &ok, "admin_addPeer", enode); err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("failed to add a peer " + enode)
+	}
+	return nil
+}
+
+// parseQuantity decodes a hex encoded quantity e.g. 0x1b4
+func parseQuantity(q string) (uint64, error) {
+	if !strings.HasPrefix(q, "0x") {
+		return 0, fmt.Errorf("invalid quantity %q", q)
+	}
+	v, err := strconv.ParseUint(q[2:], 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid quantity %q", q)
+	}
+	return v, nil
+}
@@ -0,0 +1,164 @@
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// newServer starts a stand-in endpoint answering methods with the given results.
+// A *Error value is returned as a JSON-RPC error.
+func newServer(t *testing.T, results map[string]interface{}) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req request
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid request. %v", err)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if req.Version != "2.0" {
+			t.Errorf("jsonrpc version = %q, want 2.0", req.Version)
+		}
+		resp := map[string]interface{}{"jsonrpc": "2.0", "id": req.ID}
+		result, ok := results[req.Method]
+		switch {
+		case !ok:
+			resp["error"] = &Error{Code: -32601, Message: "the method " + req.Method + " does not exist"}
+		case isError(result):
+			resp["error"] = result
+		default:
+			resp["result"] = result
+		}
+		_ = json.NewEncoder(w).Encode(resp)
+	}))
+}
+
+func isError(v interface{}) bool {
+	_, ok := v.(*Error)
+	return ok
+}
+
+func TestStatus(t *testing.T) {
+	tests := []struct {
+		name    string
+		syncing interface{}
+		want    Status
+	}{
+		{
+			name:    "synced",
+			syncing: false,
+			want:    Status{ClientVersion: "Berith/v1.0.0", BlockNumber: 436, Peers: 3, Coinbase: "0xabc"},
+		},
+		{
+			name:    "syncing",
+			syncing: map[string]string{"startingBlock": "0x0", "currentBlock": "0x1b4", "highestBlock": "0x2710"},
+			want:    Status{ClientVersion: "Berith/v1.0.0", BlockNumber: 436, Peers: 3, Syncing: true, CurrentBlock: 436, HighestBlock: 10000, Coinbase: "0xabc"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := newServer(t, map[string]interface{}{
+				"web3_clientVersion": "Berith/v1.0.0",
+				"eth_blockNumber":    "0x1b4",
+				"net_peerCount":      "0x3",
+				"eth_syncing":        tt.syncing,
+				"eth_coinbase":       "0xabc",
+			})
+			defer srv.Close()
+
+			s, err := (&Client{URL: srv.URL}).Status(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if *s != tt.want {
+				t.Errorf("status = %+v, want %+v", *s, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusWithoutCoinbase(t *testing.T) {
+	srv := newServer(t, map[string]interface{}{
+		"web3_clientVersion": "Berith/v1.0.0",
+		"eth_blockNumber":    "0x0",
+		"net_peerCount":      "0x0",
+		"eth_syncing":        false,
+		"eth_coinbase":       &Error{Code: -32000, Message: "etherbase must be explicitly specified"},
+	})
+	defer srv.Close()
+
+	s, err := (&Client{URL: srv.URL}).Status(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.Coinbase != "" {
+		t.Errorf("coinbase = %q, want empty", s.Coinbase)
+	}
+}
+
+func TestCallError(t *testing.T) {
+	srv := newServer(t, map[string]interface{}{
+		"eth_blockNumber": &Error{Code: -32000, Message: "node is stopping"},
+	})
+	defer srv.Close()
+	c := &Client{URL: srv.URL}
+
+	_, err := c.BlockNumber(context.Background())
+	rpcErr, ok := err.(*Error)
+	if !ok {
+		t.Fatalf("error = %v (%T), want *rpc.Error", err, err)
+	}
+	if rpcErr.Code != -32000 || rpcErr.Message != "node is stopping" {
+		t.Errorf("error = %+v", rpcErr)
+	}
+
+	// an unknown method is reported by the endpoint as well
+	if _, err := c.Status(context.Background()); !isError(err) {
+		t.Errorf("error = %v (%T), want *rpc.Error", err, err)
+	}
+}
+
+func TestCallHTTPError(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	_, err := (&Client{URL: srv.URL}).BlockNumber(context.Background())
+	if err == nil || isError(err) {
+		t.Errorf("error = %v (%T), want a http error", err, err)
+	}
+}
+
+func TestBlockNumberInvalidQuantity(t *testing.T) {
+	srv := newServer(t, map[string]interface{}{"eth_blockNumber": "1b4"})
+	defer srv.Close()
+
+	if _, err := (&Client{URL: srv.URL}).BlockNumber(context.Background()); err == nil {
+		t.Error("expected an error of a quantity without 0x")
+	}
+}
+
+func TestParseQuantity(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint64
+		ok   bool
+	}{
+		{"0x0", 0, true},
+		{"0x1b4", 436, true},
+		{"0xffffffffffffffff", 1<<64 - 1, true},
+		{"0x", 0, false},
+		{"1b4", 0, false},
+		{"0xzz", 0, false},
+		{"0x10000000000000000", 0, false},
+	}
+	for _, tt := range tests {
+		got, err := parseQuantity(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseQuantity(%q) = %d, %v. want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
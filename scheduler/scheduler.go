@@ -0,0 +1,40 @@
+// Package scheduler runs tasks with bounded concurrency.
+package scheduler
+
+import (
+	"sync"
+)
+
+// DefaultParallel is the concurrency used when a non positive limit is given.
+const DefaultParallel = 10
+
+// Run calls fn for every index in [0, n) with at most limit calls running
+// at the same time and blocks until all of them have returned.
+func Run(limit, n int, fn func(i int)) {
+	if n <= 0 {
+		return
+	}
+	if limit <= 0 {
+		limit = DefaultParallel
+	}
+	if limit > n {
+		limit = n
+	}
+
+	tasks := make(chan int)
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(limit)
+	for w := 0; w < limit; w++ {
+		go func() {
+			defer waitGroup.Done()
+			for i := range tasks {
+				fn(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		tasks <- i
+	}
+	close(tasks)
+	waitGroup.Wait()
+}
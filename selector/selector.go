@@ -0,0 +1,185 @@
+// Package selector parses label selector expressions such as
+// "role in (miner,bootnode),zone!=tokyo" and matches them against node labels.
+package selector
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+type operator int
+
+const (
+	opExists operator = iota
+	opNotExists
+	opEquals
+	opNotEquals
+	opIn
+	opNotIn
+)
+
+// requirement is a single condition of a selector.
+type requirement struct {
+	key    string
+	op     operator
+	values []string
+}
+
+// Selector is a conjunction of requirements. The empty selector matches everything.
+type Selector struct {
+	requirements []requirement
+}
+
+// Parse parses a comma separated list of requirements. Supported forms are
+// "key", "!key", "key=value", "key==value", "key!=value", "key in (a,b)" and "key notin (a,b)".
+func Parse(expr string) (*Selector, error) {
+	var s Selector
+	for _, term := range splitTerms(expr) {
+		term = strings.TrimSpace(term)
+		if term == "" {
+			continue
+		}
+		r, err := parseRequirement(term)
+		if err != nil {
+			return nil, err
+		}
+		s.requirements = append(s.requirements, r)
+	}
+	return &s, nil
+}
+
+// Matches returns true if the given labels satisfy every requirement.
+func (s *Selector) Matches(labels map[string]string) bool {
+	if s == nil {
+		return true
+	}
+	for _, r := range s.requirements {
+		if !r.matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (r requirement) matches(labels map[string]string) bool {
+	v, ok := labels[r.key]
+	switch r.op {
+	case opExists:
+		return ok
+	case opNotExists:
+		return !ok
+	case opEquals:
+		return ok && v == r.values[0]
+	case opNotEquals:
+		return !ok || v != r.values[0]
+	case opIn:
+		return ok && contains(r.values, v)
+	case opNotIn:
+		return !ok || !contains(r.values, v)
+	}
+	return false
+}
+
+// splitTerms splits the expression by commas which are not enclosed in parentheses.
+func splitTerms(expr string) []string {
+	var terms []string
+	depth, start := 0, 0
+	for i, c := range expr {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, expr[start:i])
+				start = i + 1
+			}
+		}
+	}
+	return append(terms, expr[start:])
+}
+
+func parseRequirement(term string) (requirement, error) {
+	if strings.HasPrefix(term, "!") {
+		key := strings.TrimSpace(term[1:])
+		if err := validateKey(key); err != nil {
+			return requirement{}, err
+		}
+		return requirement{key: key, op: opNotExists}, nil
+	}
+
+	for _, sep := range []struct {
+		token string
+		op    operator
+	}{
+		{"!=", opNotEquals},
+		{"==", opEquals},
+		{"=", opEquals},
+	} {
+		if i := strings.Index(term, sep.token); i >= 0 {
+			key := strings.TrimSpace(term[:i])
+			value := strings.TrimSpace(term[i+len(sep.token):])
+			if err := validateKey(key); err != nil {
+				return requirement{}, err
+			}
+			return requirement{key: key, op: sep.op, values: []string{value}}, nil
+		}
+	}
+
+	fields := strings.Fields(term)
+	if len(fields) == 1 {
+		if err := validateKey(fields[0]); err != nil {
+			return requirement{}, err
+		}
+		return requirement{key: fields[0], op: opExists}, nil
+	}
+	if len(fields) < 3 {
+		return requirement{}, fmt.Errorf("invalid selector requirement %q", term)
+	}
+
+	var op operator
+	switch fields[1] {
+	case "in":
+		op = opIn
+	case "notin":
+		op = opNotIn
+	default:
+		return requirement{}, fmt.Errorf("unknown operator %q in %q", fields[1], term)
+	}
+	if err := validateKey(fields[0]); err != nil {
+		return requirement{}, err
+	}
+
+	set := strings.TrimSpace(strings.Join(fields[2:], " "))
+	if !strings.HasPrefix(set, "(") || !strings.HasSuffix(set, ")") {
+		return requirement{}, fmt.Errorf("values must be enclosed in parentheses: %q", term)
+	}
+	var values []string
+	for _, v := range strings.Split(set[1:len(set)-1], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	if len(values) == 0 {
+		return requirement{}, fmt.Errorf("empty value set: %q", term)
+	}
+	return requirement{key: fields[0], op: op, values: values}, nil
+}
+
+func validateKey(key string) error {
+	if key == "" || strings.ContainsAny(key, " \t!=(),") {
+		return errors.New("invalid label key " + `"` + key + `"`)
+	}
+	return nil
+}
+
+func contains(values []string, v string) bool {
+	for _, value := range values {
+		if value == v {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,98 @@
+// Package tunnel forwards local tcp connections to remote addresses through ssh clients.
+package tunnel
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"sync"
+)
+
+// Dialer opens connections from the remote side. *ssh.Client is a Dialer.
+type Dialer interface {
+	Dial(network, addr string) (net.Conn, error)
+}
+
+// Forward is a local port forwarded to a remote address. Zero port is assigned automatically.
+type Forward struct {
+	Local  int
+	Remote string
+}
+
+// Mapping is a listening forward of a node.
+type Mapping struct {
+	Node   string `json:"node" yaml:"node"`
+	Local  string `json:"local" yaml:"local"`
+	Remote string `json:"remote" yaml:"remote"`
+}
+
+// ParseForwards pairs local ports with remote addresses in order.
+// Remote addresses without a local port get an automatically assigned one.
+func ParseForwards(locals, remotes []string) ([]Forward, error) {
+	if len(remotes) == 0 {
+		return nil, errors.New("at least one remote address must be given")
+	}
+	if len(locals) > len(remotes) {
+		return nil, fmt.Errorf("%d local ports are given for %d remote addresses", len(locals), len(remotes))
+	}
+	forwards := make([]Forward, len(remotes))
+	for i, remote := range remotes {
+		if _, _, err := net.SplitHostPort(remote); err != nil {
+			return nil, fmt.Errorf("invalid remote address %s. %v", remote, err)
+		}
+		forwards[i].Remote = remote
+		if i < len(locals) {
+			port, err := strconv.Atoi(locals[i])
+			if err != nil || port < 0 || port > 65535 {
+				return nil, errors.New("invalid local port " + locals[i])
+			}
+			forwards[i].Local = port
+		}
+	}
+	return forwards, nil
+}
+
+// Serve accepts connections on the listener and forwards each of them to addr through the dialer.
+// It returns when the listener is closed.
+func Serve(l net.Listener, d Dialer, addr string, logf func(format string, args ...interface{})) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go forward(conn, d, addr, logf)
+	}
+}
+
+// forward copies data between a local connection and a new remote connection until both sides are done
+func forward(local net.Conn, d Dialer, addr string, logf func(format string, args ...interface{})) {
+	defer local.Close()
+	remote, err := d.Dial("tcp", addr)
+	if err != nil {
+		logf("failed to dial %s for %s. %v", addr, local.RemoteAddr(), err)
+		return
+	}
+	defer remote.Close()
+
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+	pipe := func(dst, src net.Conn) {
+		defer waitGroup.Done()
+		_, _ = io.Copy(dst, src)
+		closeWrite(dst)
+	}
+	go pipe(remote, local)
+	go pipe(local, remote)
+	waitGroup.Wait()
+}
+
+// closeWrite half closes a connection if supported, otherwise closes it
+func closeWrite(c net.Conn) {
+	if cw, ok := c.(interface{ CloseWrite() error }); ok {
+		_ = cw.CloseWrite()
+		return
+	}
+	_ = c.Close()
+}
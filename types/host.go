@@ -1,18 +1,98 @@
 package types
 
+import (
+	"net"
+	"strconv"
+)
+
+// Auth methods of a host
+const (
+	AuthAgent               = "agent"
+	AuthPublicKey           = "publickey"
+	AuthPassword            = "password"
+	AuthKeyboardInteractive = "keyboard-interactive"
+)
+
 type Host struct {
-	User        string `json:"user"`
-	Address     string `json:"address"`
-	Port        int    `json:"port"`
-	Password    string `json:"password"`
-	KeyPath     string `json:"keypath"`
-	Description string `json:"description"`
+	User          string   `json:"user"`
+	Address       string   `json:"address"`
+	Port          int      `json:"port"`
+	Password      string   `json:"password"`
+	KeyPath       string   `json:"keypath"`
+	KeyPassphrase string   `json:"keypassphrase,omitempty"`
+	Auth          []string `json:"auth,omitempty"`
+	Description   string   `json:"description"`
+	HostKey       string   `json:"hostkey,omitempty"`
+	Jump          []*Jump  `json:"jump,omitempty"`
 }
 
-// Check has password or pem path.
+// Jump is a bastion to tunnel through. It refers to a stored node or an inline host.
+type Jump struct {
+	Node string `json:"node,omitempty"`
+	Host *Host  `json:"host,omitempty"`
+}
+
+// Check has password or pem path, or uses ssh-agent or keyboard-interactive auth.
 func (h *Host) HasCredentials() bool {
-	if h.Password == "" && h.KeyPath == "" {
-		return false
+	if h.Password != "" || h.KeyPath != "" {
+		return true
+	}
+	for _, method := range h.Auth {
+		if method == AuthAgent || method == AuthKeyboardInteractive {
+			return true
+		}
+	}
+	return false
+}
+
+// AuthMethods returns auth methods in the order to try.
+// Without explicit methods, a key is tried before a password.
+func (h *Host) AuthMethods() []string {
+	if len(h.Auth) > 0 {
+		return h.Auth
+	}
+	var methods []string
+	if h.KeyPath != "" {
+		methods = append(methods, AuthPublicKey)
+	}
+	if h.Password != "" {
+		methods = append(methods, AuthPassword, AuthKeyboardInteractive)
+	}
+	return methods
+}
+
+// Addr returns the address of the host to dial
+func (h *Host) Addr() string {
+	return net.JoinHostPort(h.Address, strconv.Itoa(h.Port))
+}
+
+// Secrets returns pointers to the fields which must never be stored or printed in plain text,
+// including secrets of inline jump hosts.
+func (h *Host) Secrets() []*string {
+	secrets := []*string{&h.Password, &h.KeyPassphrase}
+	for _, j := range h.Jump {
+		if j.Host != nil {
+			secrets = append(secrets, j.Host.Secrets()...)
+		}
+	}
+	return secrets
+}
+
+// Copy returns a copy of the host. Inline jump hosts are copied as well.
+func (h *Host) Copy() *Host {
+	c := *h
+	if h.Auth != nil {
+		c.Auth = append([]string(nil), h.Auth...)
+	}
+	if h.Jump != nil {
+		c.Jump = make([]*Jump, len(h.Jump))
+		for i, j := range h.Jump {
+			cj := *j
+			if j.Host != nil {
+				cj.Host = j.Host.Copy()
+			}
+			c.Jump[i] = &cj
+		}
 	}
-	return true
+	return &c
 }
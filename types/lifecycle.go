@@ -0,0 +1,69 @@
+package types
+
+// Lifecycle phases of a berith node
+const (
+	PhaseInit  = "init"
+	PhaseBuild = "build"
+	PhaseStart = "start"
+	PhaseStop  = "stop"
+)
+
+// Lifecycle is the remote workspace of a node and the command template of each phase.
+// Templates are go text/templates given the node name, host, labels and workspace.
+type Lifecycle struct {
+	Workspace string `json:"workspace,omitempty"`
+	Init      string `json:"init,omitempty"`
+	Build     string `json:"build,omitempty"`
+	Start     string `json:"start,omitempty"`
+	Stop      string `json:"stop,omitempty"`
+}
+
+// DefaultLifecycle returns the built-in lifecycle which runs scripts in ~/berith-test.
+func DefaultLifecycle() *Lifecycle {
+	return &Lifecycle{
+		Workspace: "~/berith-test",
+		Init:      "{{.Workspace}}/init.sh {{.Name}}",
+		Build:     "{{.Workspace}}/build.sh {{.Name}}",
+		Start:     "{{.Workspace}}/start.sh {{.Name}}",
+		Stop:      "{{.Workspace}}/stop.sh {{.Name}}",
+	}
+}
+
+// Script returns the command template of a phase.
+func (l *Lifecycle) Script(phase string) string {
+	switch phase {
+	case PhaseInit:
+		return l.Init
+	case PhaseBuild:
+		return l.Build
+	case PhaseStart:
+		return l.Start
+	case PhaseStop:
+		return l.Stop
+	}
+	return ""
+}
+
+// Merge returns a copy of the lifecycle whose empty fields are taken from base.
+func (l *Lifecycle) Merge(base *Lifecycle) *Lifecycle {
+	merged := *base
+	if l == nil {
+		return &merged
+	}
+	if l.Workspace != "" {
+		merged.Workspace = l.Workspace
+	}
+	if l.Init != "" {
+		merged.Init = l.Init
+	}
+	if l.Build != "" {
+		merged.Build = l.Build
+	}
+	if l.Start != "" {
+		merged.Start = l.Start
+	}
+	if l.Stop != "" {
+		merged.Stop = l.Stop
+	}
+	return &merged
+}
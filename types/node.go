@@ -3,8 +3,13 @@ package types
 var NodePrefix = "node."
 
 type Node struct {
-	Name string `json:"name"`
-	Host *Host  `json:"host"`
+	Name      string            `json:"name"`
+	Host      *Host             `json:"host"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Lifecycle *Lifecycle        `json:"lifecycle,omitempty"`
+	Enode     string            `json:"enode,omitempty"`
+	Account   string            `json:"account,omitempty"`
+	Revision  uint64            `json:"revision,omitempty"`
 }
 
 // HasCredentials checks has password or pem path or not
@@ -2,20 +2,49 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
 	"github.com/urfave/cli"
+	"golang.org/x/crypto/ssh/terminal"
+	"os"
 	"os/user"
 	"path/filepath"
+	"time"
 )
 
 var (
+	StoreFlag = cli.StringFlag{
+		Name:   "store",
+		Usage:  "data store of nodes. leveldb in the workspace, memory, or path of a .json, .yaml or .yml file to share with version control.",
+		Value:  "leveldb",
+		EnvVar: "BERITHUTILS_STORE",
+	}
+	BackupKeepFlag = cli.IntFlag{
+		Name:   "backup-keep",
+		Usage:  "number of automatic backups kept in the workspace, taken before destructive operations. 0 disables them.",
+		Value:  10,
+		EnvVar: "BERITHUTILS_BACKUP_KEEP",
+	}
 	PathFlag = cli.StringFlag{
 		Name:  "path",
 		Usage: "path of config file.",
 	}
+	BestEffortFlag = cli.BoolFlag{
+		Name:  "best-effort",
+		Usage: "import nodes one by one, skipping failed ones, instead of all or nothing.",
+	}
 	NodeNameFlag = cli.StringFlag{
 		Name:  "name",
 		Usage: "name of a node",
 	}
+	NewNameFlag = cli.StringFlag{
+		Name:  "new-name",
+		Usage: "new name to rename a node to.",
+	}
+	RevisionFlag = cli.Uint64Flag{
+		Name:  "revision",
+		Usage: "revision of a node expected to be stored. the update fails if it was modified since. zero skips the check.",
+	}
 	HostUserFlag = cli.StringFlag{
 		Name:  "host.user",
 		Usage: "host username for ssh.",
@@ -37,10 +66,223 @@ var (
 		Name:  "host.keypath",
 		Usage: "host key file path for ssh.",
 	}
+	HostKeyPassphraseFlag = cli.StringFlag{
+		Name:  "host.keypassphrase",
+		Usage: "passphrase of the host key file. asked on the terminal if needed and empty.",
+	}
+	HostAuthFlag = cli.StringSliceFlag{
+		Name:  "host.auth",
+		Usage: "auth method to try in order. agent, publickey, password or keyboard-interactive. can be repeated.",
+	}
+	HostJumpFlag = cli.StringSliceFlag{
+		Name:  "host.jump",
+		Usage: "name of a stored node used as a jump host. can be repeated in hop order.",
+	}
 	HostDescriptionFlag = cli.StringFlag{
 		Name:  "host.description",
 		Usage: "description of host.",
 	}
+	WorkspaceFlag = cli.StringFlag{
+		Name:  "workspace",
+		Usage: "remote workspace directory of a node. e.g. ~/berith-test",
+	}
+	ScriptInitFlag = cli.StringFlag{
+		Name:  "script.init",
+		Usage: "command template of init phase. e.g. '{{.Workspace}}/init.sh {{.Name}}'",
+	}
+	ScriptBuildFlag = cli.StringFlag{
+		Name:  "script.build",
+		Usage: "command template of build phase.",
+	}
+	ScriptStartFlag = cli.StringFlag{
+		Name:  "script.start",
+		Usage: "command template of start phase.",
+	}
+	ScriptStopFlag = cli.StringFlag{
+		Name:  "script.stop",
+		Usage: "command template of stop phase.",
+	}
+	NodeLabelFlag = cli.StringSliceFlag{
+		Name:  "label",
+		Usage: "label of a node as key=value. can be repeated.",
+	}
+	ParallelFlag = cli.IntFlag{
+		Name:  "parallel",
+		Usage: "maximum number of nodes handled at the same time.",
+		Value: 10,
+	}
+	PerNodeFilesFlag = cli.IntFlag{
+		Name:  "per-node-files",
+		Usage: "maximum number of files uploaded to a node at the same time.",
+		Value: 4,
+	}
+	DeleteFlag = cli.BoolFlag{
+		Name:  "delete",
+		Usage: "delete remote files which do not exist locally.",
+	}
+	ForceFlag = cli.BoolFlag{
+		Name:  "force",
+		Usage: "upload every file without comparing checksums.",
+	}
+	DryRunFlag = cli.BoolFlag{
+		Name:  "dry-run",
+		Usage: "report changes without applying them.",
+	}
+	EncryptFlag = cli.BoolFlag{
+		Name:  "encrypt",
+		Usage: "encrypt the backup with a passphrase read from BERITHUTILS_BACKUP_PASSPHRASE or the terminal.",
+	}
+	RecoverFlag = cli.BoolFlag{
+		Name:  "recover",
+		Usage: "recover a corrupted leveldb store after copying it next to the original.",
+	}
+	BundleFlag = cli.BoolFlag{
+		Name:  "bundle",
+		Usage: "bundle fetched files into a tar.gz archive next to the local directory.",
+	}
+	StreamFlag = cli.BoolFlag{
+		Name:  "stream",
+		Usage: "print remote output lines as they arrive, prefixed with the node name.",
+	}
+	NoColorFlag = cli.BoolFlag{
+		Name:  "no-color",
+		Usage: "disable colors of streamed output.",
+	}
+	AllowFailuresFlag = cli.BoolFlag{
+		Name:  "allow-failures",
+		Usage: "exit with zero status even if some nodes failed.",
+	}
+	OutputFlag = cli.StringFlag{
+		Name:  "output",
+		Usage: "output format. text, json, yaml, table or template.",
+		Value: "text",
+	}
+	TemplateFlag = cli.StringFlag{
+		Name:  "template",
+		Usage: "go text/template applied to each output item. implies --output template.",
+	}
+	HostKeyPolicyFlag = cli.StringFlag{
+		Name:  "host-key-policy",
+		Usage: "policy for unknown host keys. strict, tofu(trust on first use and pin) or insecure.",
+		Value: "tofu",
+	}
+	KnownHostsFlag = cli.StringFlag{
+		Name:  "known-hosts",
+		Usage: "known_hosts file to verify host keys. default is ~/.ssh/known_hosts",
+	}
+	PinFlag = cli.BoolFlag{
+		Name:  "pin",
+		Usage: "pin scanned host keys of nodes which have no pinned key.",
+	}
+	SelectorFlag = cli.StringFlag{
+		Name:  "select",
+		Usage: "label selector of nodes. e.g. 'role in (miner,bootnode),zone!=tokyo'",
+	}
+	ConnectTimeoutFlag = cli.DurationFlag{
+		Name:  "connect-timeout",
+		Usage: "timeout to connect and authenticate to each ssh host including jump hosts.",
+		Value: 30 * time.Second,
+	}
+	TimeoutFlag = cli.DurationFlag{
+		Name:  "timeout",
+		Usage: "timeout of the whole operation on each node. zero means no timeout.",
+	}
+	RetryAttemptsFlag = cli.IntFlag{
+		Name:  "retry.attempts",
+		Usage: "maximum number of tries on each node including the first one.",
+		Value: 1,
+	}
+	RetryBackoffFlag = cli.DurationFlag{
+		Name:  "retry.backoff",
+		Usage: "delay before the first retry. it doubles after every retry.",
+		Value: time.Second,
+	}
+	RetryMaxBackoffFlag = cli.DurationFlag{
+		Name:  "retry.max-backoff",
+		Usage: "maximum delay between retries. 0 uses 10m.",
+		Value: 30 * time.Second,
+	}
+	RetryJitterFlag = cli.Float64Flag{
+		Name:  "retry.jitter",
+		Usage: "randomize each delay by up to this fraction of it. 0 to 1.",
+		Value: 0.2,
+	}
+	RetryOnFlag = cli.StringSliceFlag{
+		Name:  "retry.on",
+		Usage: "error classes to retry. dial, hostkey, auth, session, remote-exit, transfer or rpc. default is dial, session and transfer.",
+	}
+	TunnelLocalFlag = cli.StringSliceFlag{
+		Name:  "local",
+		Usage: "local port of each forward in the order of --remote. ports of a single node only. others are assigned automatically.",
+	}
+	TunnelRemoteFlag = cli.StringSliceFlag{
+		Name:  "remote",
+		Usage: "address to forward to as seen from the node. e.g. 127.0.0.1:8545",
+	}
+	RPCFlag = cli.StringFlag{
+		Name:  "rpc",
+		Usage: "json-rpc endpoint of each node. a template given the node name, host, labels and workspace. it is reached through ssh unless --rpc.direct",
+		Value: "http://127.0.0.1:8545",
+	}
+	RPCDirectFlag = cli.BoolFlag{
+		Name:  "rpc.direct",
+		Usage: "connect json-rpc endpoints directly instead of through ssh.",
+	}
+	EnodeExecFlag = cli.StringFlag{
+		Name:  "enode.exec",
+		Usage: "command template printing the enode url of each node. e.g. berith attach --exec admin.nodeInfo.enode {{.Workspace}}/data/berith.ipc. admin_nodeInfo over json-rpc is used if empty.",
+	}
+	StaticNodesFlag = cli.StringFlag{
+		Name:  "static-nodes",
+		Usage: "remote path template of static-nodes.json. relative paths are in the workspace.",
+		Value: "data/berith/static-nodes.json",
+	}
+	TopologyFlag = cli.StringFlag{
+		Name:  "topology",
+		Usage: "peers of each node. mesh, ring or star:<hub node name>.",
+		Value: "mesh",
+	}
+	AddPeerFlag = cli.BoolFlag{
+		Name:  "add-peer",
+		Usage: "also connect running nodes to their peers with admin_addPeer.",
+	}
+	GenesisFileFlag = cli.StringFlag{
+		Name:  "genesis",
+		Usage: "local genesis file. relative paths are in the workspace.",
+		Value: "genesis.json",
+	}
+	GenesisTemplateFlag = cli.StringFlag{
+		Name:  "genesis.template",
+		Usage: "genesis template file given chain id, timestamp, balance, accounts and nodes. a built-in template is used if empty.",
+	}
+	GenesisRemoteFlag = cli.StringFlag{
+		Name:  "genesis.remote",
+		Usage: "remote path template of the genesis file. relative paths are in the workspace.",
+		Value: "genesis.json",
+	}
+	ChainIDFlag = cli.Int64Flag{
+		Name:  "chain-id",
+		Usage: "chain id of the network.",
+		Value: 1234,
+	}
+	BalanceFlag = cli.StringFlag{
+		Name:  "balance",
+		Usage: "initial balance of each account.",
+		Value: "0x200000000000000000000000000000000000000000000000000000000000000",
+	}
+	AccountExecFlag = cli.StringFlag{
+		Name:  "account.exec",
+		Usage: "command template printing the account of each node. eth_coinbase over json-rpc is used if empty.",
+	}
+	InitFlag = cli.BoolFlag{
+		Name:  "init",
+		Usage: "run the init script after uploading and compare genesis hashes it logs.",
+	}
+	TunnelBindFlag = cli.StringFlag{
+		Name:  "bind",
+		Usage: "local address to listen on.",
+		Value: "127.0.0.1",
+	}
 )
 
 func NewApp() *cli.App {
@@ -61,7 +303,36 @@ func GetDatabasePath() (string, error) {
 	return filepath.Join(workspace, "berithutilsdb"), nil
 }
 
+// IsTerminal returns true if the given file is a terminal
+func IsTerminal(f *os.File) bool {
+	return terminal.IsTerminal(int(f.Fd()))
+}
+
+// GetKnownHostsPath returns the default known_hosts file of the current user
+func GetKnownHostsPath() string {
+	cu, err := user.Current()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(cu.HomeDir, ".ssh", "known_hosts")
+}
+
 func GetWorkspace() (string, error) {
 	cu, _ := user.Current()
 	return filepath.Join(cu.HomeDir, "berithutils"), nil
 }
+
+// ReadPassphrase reads a line from the terminal without echo.
+func ReadPassphrase(prompt string) (string, error) {
+	fd := int(os.Stdin.Fd())
+	if !terminal.IsTerminal(fd) {
+		return "", errors.New("cannot read a passphrase. stdin is not a terminal")
+	}
+	_, _ = fmt.Fprint(os.Stderr, prompt)
+	b, err := terminal.ReadPassword(fd)
+	_, _ = fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
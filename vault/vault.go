@@ -0,0 +1,372 @@
+// Package vault seals secret host fields with a key derived from a master passphrase.
+package vault
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/mesia777/berith-utils/db"
+	"github.com/mesia777/berith-utils/types"
+	"golang.org/x/crypto/scrypt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	// PassphraseEnv is the environment variable consulted before prompting for the master passphrase.
+	PassphraseEnv = "BERITHUTILS_VAULT_PASSPHRASE"
+
+	sealedPrefix = "vault:v1:"
+	checkValue   = "berithutils-vault"
+)
+
+var (
+	metaKey = []byte("vault.meta")
+
+	ErrNotInitialized = errors.New("vault is not initialized")
+	ErrAlreadyExist   = errors.New("vault is already initialized")
+	ErrLocked         = errors.New("vault is locked")
+	ErrBadPassphrase  = errors.New("invalid vault passphrase")
+)
+
+// PassphraseFunc reads a passphrase from the user given a prompt.
+type PassphraseFunc func(prompt string) (string, error)
+
+// meta is the persisted key derivation parameters of a vault.
+type meta struct {
+	Salt  []byte `json:"salt"`
+	N     int    `json:"n"`
+	R     int    `json:"r"`
+	P     int    `json:"p"`
+	Check string `json:"check"`
+}
+
+// Vault encrypts and decrypts secret fields of hosts.
+// It is unlocked at most once per process, from PassphraseEnv or the prompt.
+type Vault struct {
+	db     db.Store
+	prompt PassphraseFunc
+
+	mu   sync.Mutex
+	meta *meta
+	aead cipher.AEAD
+}
+
+// New returns a vault backed by the given database.
+func New(database db.Store, prompt PassphraseFunc) (*Vault, error) {
+	v := &Vault{
+		db:     database,
+		prompt: prompt,
+	}
+
+	has, err := database.Has(metaKey)
+	if err != nil {
+		return nil, err
+	}
+	if !has {
+		return v, nil
+	}
+
+	val, err := database.Get(metaKey)
+	if err != nil {
+		return nil, err
+	}
+	var m meta
+	if err := json.Unmarshal(val, &m); err != nil {
+		return nil, err
+	}
+	v.meta = &m
+	return v, nil
+}
+
+// Initialized returns true if a master passphrase was set.
+func (v *Vault) Initialized() bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.meta != nil
+}
+
+// Init sets the master passphrase of a new vault and leaves it unlocked.
+func (v *Vault) Init(passphrase string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.meta != nil {
+		return ErrAlreadyExist
+	}
+	m, aead, err := newMeta(passphrase)
+	if err != nil {
+		return err
+	}
+	if err := v.saveMeta(m); err != nil {
+		return err
+	}
+	v.meta, v.aead = m, aead
+	return nil
+}
+
+// Unlock derives the key from PassphraseEnv or the prompt if the vault is still locked.
+func (v *Vault) Unlock() error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	return v.unlock()
+}
+
+// UnlockWith derives the key from the given passphrase.
+func (v *Vault) UnlockWith(passphrase string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if v.meta == nil {
+		return ErrNotInitialized
+	}
+	aead, err := v.meta.open(passphrase)
+	if err != nil {
+		return err
+	}
+	v.aead = aead
+	return nil
+}
+
+// Lock drops the derived key from memory.
+func (v *Vault) Lock() {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.aead = nil
+}
+
+// Rekey replaces the master passphrase. fn must re-seal every stored host with the given function
+// and put it in the transaction, which also writes the new key parameters. If fn or the commit fails,
+// nothing is written and the vault keeps its old key.
+func (v *Vault) Rekey(passphrase string, fn func(tx db.Tx, reseal func(h *types.Host) error) error) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	if err := v.unlock(); err != nil {
+		return err
+	}
+	m, aead, err := newMeta(passphrase)
+	if err != nil {
+		return err
+	}
+	old := v.aead
+	reseal := func(h *types.Host) error {
+		for _, s := range h.Secrets() {
+			plain, err := open(old, *s)
+			if err != nil {
+				return err
+			}
+			if *s, err = seal(aead, plain); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	err = v.db.Update(func(tx db.Tx) error {
+		if err := fn(tx, reseal); err != nil {
+			return err
+		}
+		return putMeta(tx, m)
+	})
+	if err != nil {
+		return err
+	}
+	v.meta, v.aead = m, aead
+	return nil
+}
+
+// Seal encrypts the secret fields of the given host in place.
+// Hosts are left untouched while the vault is not initialized.
+func (v *Vault) Seal(h *types.Host) error {
+	if h == nil || !v.Initialized() || !hasPlain(h) {
+		return nil
+	}
+	if err := v.Unlock(); err != nil {
+		return err
+	}
+	for _, s := range h.Secrets() {
+		if *s == "" || IsSealed(*s) {
+			continue
+		}
+		sealed, err := seal(v.aead, *s)
+		if err != nil {
+			return err
+		}
+		*s = sealed
+	}
+	return nil
+}
+
+// Open returns a copy of the given host with decrypted secret fields.
+func (v *Vault) Open(h *types.Host) (*types.Host, error) {
+	if h == nil {
+		return nil, nil
+	}
+	c := h.Copy()
+	if !hasSealed(c) {
+		return c, nil
+	}
+	if err := v.Unlock(); err != nil {
+		return nil, err
+	}
+	for _, s := range c.Secrets() {
+		plain, err := open(v.aead, *s)
+		if err != nil {
+			return nil, err
+		}
+		*s = plain
+	}
+	return c, nil
+}
+
+// IsSealed returns true if the given value was encrypted by a vault.
+func IsSealed(s string) bool {
+	return strings.HasPrefix(s, sealedPrefix)
+}
+
+// HasPlainSecrets returns true if any secret field of the host is stored in plain text.
+func HasPlainSecrets(h *types.Host) bool {
+	return h != nil && hasPlain(h)
+}
+
+func (v *Vault) unlock() error {
+	if v.meta == nil {
+		return ErrNotInitialized
+	}
+	if v.aead != nil {
+		return nil
+	}
+
+	passphrase, ok := os.LookupEnv(PassphraseEnv)
+	if !ok {
+		if v.prompt == nil {
+			return ErrLocked
+		}
+		var err error
+		passphrase, err = v.prompt("vault passphrase: ")
+		if err != nil {
+			return err
+		}
+	}
+	aead, err := v.meta.open(passphrase)
+	if err != nil {
+		return err
+	}
+	v.aead = aead
+	return nil
+}
+
+func (v *Vault) saveMeta(m *meta) error {
+	return putMeta(v.db, m)
+}
+
+func putMeta(tx db.Tx, m *meta) error {
+	encoded, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return tx.Put(metaKey, encoded)
+}
+
+// newMeta derives a key from the passphrase with a fresh salt.
+func newMeta(passphrase string) (*meta, cipher.AEAD, error) {
+	if passphrase == "" {
+		return nil, nil, errors.New("passphrase must not be empty")
+	}
+	m := &meta{
+		Salt: make([]byte, 32),
+		N:    1 << 15,
+		R:    8,
+		P:    1,
+	}
+	if _, err := io.ReadFull(rand.Reader, m.Salt); err != nil {
+		return nil, nil, err
+	}
+	aead, err := m.derive(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	if m.Check, err = seal(aead, checkValue); err != nil {
+		return nil, nil, err
+	}
+	return m, aead, nil
+}
+
+// open derives the key and verifies it against the check value.
+func (m *meta) open(passphrase string) (cipher.AEAD, error) {
+	aead, err := m.derive(passphrase)
+	if err != nil {
+		return nil, err
+	}
+	check, err := open(aead, m.Check)
+	if err != nil || check != checkValue {
+		return nil, ErrBadPassphrase
+	}
+	return aead, nil
+}
+
+func (m *meta) derive(passphrase string) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(passphrase), m.Salt, m.N, m.R, m.P, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func seal(aead cipher.AEAD, plain string) (string, error) {
+	if plain == "" {
+		return "", nil
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, []byte(plain), nil)
+	return sealedPrefix + base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+func open(aead cipher.AEAD, s string) (string, error) {
+	if !IsSealed(s) {
+		return s, nil
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(s, sealedPrefix))
+	if err != nil {
+		return "", err
+	}
+	if len(raw) < aead.NonceSize() {
+		return "", errors.New("sealed value is too short")
+	}
+	nonce, sealed := raw[:aead.NonceSize()], raw[aead.NonceSize():]
+	plain, err := aead.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", ErrBadPassphrase
+	}
+	return string(plain), nil
+}
+
+func hasPlain(h *types.Host) bool {
+	for _, s := range h.Secrets() {
+		if *s != "" && !IsSealed(*s) {
+			return true
+		}
+	}
+	return false
+}
+
+func hasSealed(h *types.Host) bool {
+	for _, s := range h.Secrets() {
+		if IsSealed(*s) {
+			return true
+		}
+	}
+	return false
+}